@@ -0,0 +1,218 @@
+package otk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type BreakerState uint8
+
+const (
+	// BreakerClosed lets all calls through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails all calls fast until the cool down is over.
+	BreakerOpen
+	// BreakerHalfOpen lets a limited number of probe calls through to decide whether to close or open again.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("BreakerState(%d)", s)
+	}
+}
+
+// ErrBreakerOpen matches any *BreakerOpenError using errors.Is.
+var ErrBreakerOpen = errors.New("circuit breaker is open")
+
+// BreakerOpenError is returned when a Breaker rejects a call.
+type BreakerOpenError struct {
+	Name  string
+	State BreakerState
+	// RetryIn is how long until the breaker lets probes through, 0 if it's half-open.
+	RetryIn time.Duration
+}
+
+func (e *BreakerOpenError) Error() string {
+	if e.Name == "" {
+		return fmt.Sprintf("circuit breaker is %s", e.State)
+	}
+	return fmt.Sprintf("circuit breaker %s is %s", e.Name, e.State)
+}
+
+func (e *BreakerOpenError) Is(target error) bool { return target == ErrBreakerOpen }
+
+// errBreakerIgnore is passed to done when the call never happened, it's ignored no matter what IsFailure says.
+var errBreakerIgnore = errors.New("ignored")
+
+// BreakerOptions are the settings for NewBreaker.
+type BreakerOptions struct {
+	Name string
+
+	// FailureThreshold is the number of consecutive failures that opens the breaker, defaults to 5.
+	FailureThreshold uint
+	// CoolDown is how long the breaker stays open before letting probes through, defaults to 30 seconds.
+	CoolDown time.Duration
+	// Probes is the number of successful calls needed to close a half-open breaker,
+	// it's also the maximum number of concurrent calls while half-open, defaults to 1.
+	Probes uint
+
+	// IsFailure decides if err counts as a failure, defaults to any error except context.Canceled.
+	// Errors it rejects are ignored, they count as neither a failure nor a success.
+	IsFailure func(err error) bool
+	// OnStateChange is called on every state transition, after the breaker is unlocked.
+	OnStateChange func(name string, from, to BreakerState)
+}
+
+// NewBreaker returns a Breaker that uses the Clock set on ctx by WithClock.
+func NewBreaker(ctx context.Context, opts *BreakerOptions) *Breaker {
+	b := Breaker{clk: ClockFromContext(ctx)}
+	if opts != nil {
+		b.opts = *opts
+	}
+
+	if b.opts.FailureThreshold == 0 {
+		b.opts.FailureThreshold = 5
+	}
+	if b.opts.CoolDown < 1 {
+		b.opts.CoolDown = 30 * time.Second
+	}
+	if b.opts.Probes == 0 {
+		b.opts.Probes = 1
+	}
+	if b.opts.IsFailure == nil {
+		b.opts.IsFailure = func(err error) bool { return err != nil && !errors.Is(err, context.Canceled) }
+	}
+	return &b
+}
+
+// Breaker is a circuit breaker, it stops calls to a dependency after it fails FailureThreshold
+// times in a row, then lets a few probes through after CoolDown to check if it recovered.
+type Breaker struct {
+	mux  sync.Mutex
+	opts BreakerOptions
+	clk  Clock
+
+	state    BreakerState
+	gen      uint64
+	openedAt time.Time
+	failures uint
+	inFlight uint
+	passed   uint
+}
+
+// Allow returns an error if the breaker doesn't allow calls right now,
+// otherwise the caller must make the call and pass its result to done.
+func (b *Breaker) Allow() (done func(err error), err error) {
+	b.mux.Lock()
+	now := b.clk.Now()
+	notify := b.updateLocked(now)
+	defer func() {
+		b.mux.Unlock()
+		notify()
+	}()
+
+	switch b.state {
+	case BreakerOpen:
+		return nil, &BreakerOpenError{Name: b.opts.Name, State: b.state, RetryIn: b.openedAt.Add(b.opts.CoolDown).Sub(now)}
+	case BreakerHalfOpen:
+		if b.inFlight >= b.opts.Probes-b.passed {
+			return nil, &BreakerOpenError{Name: b.opts.Name, State: b.state}
+		}
+	}
+
+	b.inFlight++
+	gen := b.gen
+	var once sync.Once
+	return func(err error) { once.Do(func() { b.done(gen, err) }) }, nil
+}
+
+// Do calls fn if the breaker allows it and records the result.
+func (b *Breaker) Do(fn func() error) error {
+	done, err := b.Allow()
+	if err != nil {
+		return err
+	}
+	err = fn()
+	done(err)
+	return err
+}
+
+func (b *Breaker) State() BreakerState {
+	b.mux.Lock()
+	notify := b.updateLocked(b.clk.Now())
+	st := b.state
+	b.mux.Unlock()
+	notify()
+	return st
+}
+
+// Reset closes the breaker and clears its failures.
+func (b *Breaker) Reset() {
+	b.mux.Lock()
+	notify := b.setStateLocked(BreakerClosed, b.clk.Now())
+	b.mux.Unlock()
+	notify()
+}
+
+func (b *Breaker) done(gen uint64, err error) {
+	b.mux.Lock()
+	if gen != b.gen { // the state changed since the call was allowed
+		b.mux.Unlock()
+		return
+	}
+
+	b.inFlight--
+	now, notify := b.clk.Now(), func() {}
+	switch failed := err != nil && err != errBreakerIgnore && b.opts.IsFailure(err); {
+	case err != nil && !failed:
+		// ignored, the probe slot is free again
+	case b.state == BreakerHalfOpen && failed:
+		notify = b.setStateLocked(BreakerOpen, now)
+	case b.state == BreakerHalfOpen:
+		if b.passed++; b.passed >= b.opts.Probes {
+			notify = b.setStateLocked(BreakerClosed, now)
+		}
+	case failed:
+		if b.failures++; b.failures >= b.opts.FailureThreshold {
+			notify = b.setStateLocked(BreakerOpen, now)
+		}
+	default:
+		b.failures = 0
+	}
+	b.mux.Unlock()
+	notify()
+}
+
+func (b *Breaker) updateLocked(now time.Time) func() {
+	if b.state == BreakerOpen && !now.Before(b.openedAt.Add(b.opts.CoolDown)) {
+		return b.setStateLocked(BreakerHalfOpen, now)
+	}
+	return func() {}
+}
+
+// setStateLocked returns a func to call the OnStateChange callback after unlocking.
+func (b *Breaker) setStateLocked(st BreakerState, now time.Time) func() {
+	from := b.state
+	b.state, b.gen = st, b.gen+1
+	b.failures, b.inFlight, b.passed = 0, 0, 0
+	if st == BreakerOpen {
+		b.openedAt = now
+	}
+
+	if from == st || b.opts.OnStateChange == nil {
+		return func() {}
+	}
+	name, fn := b.opts.Name, b.opts.OnStateChange
+	return func() { fn(name, from, st) }
+}
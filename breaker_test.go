@@ -0,0 +1,140 @@
+package otk
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	clk := NewManualClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	var transitions []string
+	b := NewBreaker(WithClock(context.Background(), clk), &BreakerOptions{
+		Name:             "upstream",
+		FailureThreshold: 3,
+		CoolDown:         time.Minute,
+		Probes:           2,
+		OnStateChange: func(name string, from, to BreakerState) {
+			transitions = append(transitions, name+":"+from.String()+"->"+to.String())
+		},
+	})
+
+	errFail := errors.New("fail")
+	fail := func() error { return errFail }
+	ok := func() error { return nil }
+
+	b.Do(fail)
+	b.Do(fail)
+	b.Do(ok) // resets the consecutive failures
+	for i := 0; i < 3; i++ {
+		if err := b.Do(fail); err != errFail {
+			t.Fatalf("expected errFail, got %v", err)
+		}
+	}
+
+	err := b.Do(ok)
+	var boe *BreakerOpenError
+	if !errors.Is(err, ErrBreakerOpen) || !errors.As(err, &boe) || boe.Name != "upstream" || boe.RetryIn != time.Minute {
+		t.Fatalf("expected a BreakerOpenError, got %#v", err)
+	}
+
+	clk.Advance(time.Minute)
+	if st := b.State(); st != BreakerHalfOpen {
+		t.Fatalf("expected half-open, got %v", st)
+	}
+
+	// half-open only allows Probes calls at a time, and a failure opens it again
+	done1, err1 := b.Allow()
+	done2, err2 := b.Allow()
+	if _, err := b.Allow(); err1 != nil || err2 != nil || !errors.Is(err, ErrBreakerOpen) {
+		t.Fatalf("unexpected probe errors: %v, %v, %v", err1, err2, err)
+	}
+	done1(nil)
+	done2(errFail)
+	if st := b.State(); st != BreakerOpen {
+		t.Fatalf("expected open, got %v", st)
+	}
+
+	clk.Advance(time.Minute)
+	b.Do(ok)
+	b.Do(ok)
+	if st := b.State(); st != BreakerClosed {
+		t.Fatalf("expected closed, got %v", st)
+	}
+
+	exp := []string{
+		"upstream:closed->open", "upstream:open->half-open", "upstream:half-open->open",
+		"upstream:open->half-open", "upstream:half-open->closed",
+	}
+	if !reflect.DeepEqual(transitions, exp) {
+		t.Fatalf("expected %v, got %v", exp, transitions)
+	}
+}
+
+func TestBreakerIgnoredErrors(t *testing.T) {
+	clk := NewManualClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	b := NewBreaker(WithClock(context.Background(), clk), &BreakerOptions{FailureThreshold: 2, CoolDown: time.Minute})
+
+	errFail := errors.New("fail")
+	canceled := func() error { return context.Canceled }
+
+	// a canceled call doesn't reset the consecutive failures
+	b.Do(func() error { return errFail })
+	b.Do(canceled)
+	b.Do(func() error { return errFail })
+	if st := b.State(); st != BreakerOpen {
+		t.Fatalf("expected open, got %v", st)
+	}
+
+	// nor does a canceled probe close the breaker, it just frees the probe slot
+	clk.Advance(time.Minute)
+	if err := b.Do(canceled); err != context.Canceled {
+		t.Fatalf("expected the probe to run, got %v", err)
+	}
+	if st := b.State(); st != BreakerHalfOpen {
+		t.Fatalf("expected half-open, got %v", st)
+	}
+	if err := b.Do(func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if st := b.State(); st != BreakerClosed {
+		t.Fatalf("expected closed, got %v", st)
+	}
+}
+
+func TestHTTPClientBreaker(t *testing.T) {
+	var hits atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	// the limiter never refills, so requests would hang if they waited on it while the breaker is open
+	ctx := WithClock(context.Background(), NewManualClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)))
+	c := HTTPClient{
+		Limiter: NewRateLimiter(ctx, 1, 2),
+		Breaker: NewBreaker(ctx, &BreakerOptions{FailureThreshold: 2}),
+	}
+	for i := 0; i < 5; i++ {
+		err := c.Request("GET", "", srv.URL, nil, nil)
+		if i < 2 && err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if i >= 2 && !errors.Is(err, ErrBreakerOpen) {
+			t.Fatalf("expected ErrBreakerOpen, got %v", err)
+		}
+	}
+
+	if n := hits.Load(); n != 2 {
+		t.Fatalf("expected 2 requests to reach the server, got %d", n)
+	}
+	if n := c.Limiter.Tokens(); n != 0 {
+		t.Fatalf("expected rejected requests not to use the limiter, got %v tokens", n)
+	}
+}
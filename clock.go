@@ -0,0 +1,227 @@
+package otk
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Clock abstracts the time functions used by Scheduler, RetryCtx and Workers,
+// so tests can control time using a ManualClock, see WithClock.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// SystemClock is the real clock, backed by the time package.
+var SystemClock Clock = systemClock{}
+
+type clockCtxKey struct{}
+
+// WithClock returns a copy of ctx that carries clk, which is used by anything created with that context.
+func WithClock(ctx context.Context, clk Clock) context.Context {
+	return context.WithValue(ctx, clockCtxKey{}, clk)
+}
+
+// ClockFromContext returns the clock set by WithClock or SystemClock.
+func ClockFromContext(ctx context.Context) Clock {
+	if clk, ok := ctx.Value(clockCtxKey{}).(Clock); ok && clk != nil {
+		return clk
+	}
+	return SystemClock
+}
+
+// sleepCtx sleeps for d using clk, returns ctx.Err() if ctx is done first.
+func sleepCtx(ctx context.Context, clk Clock, d time.Duration) error {
+	tm := clk.NewTimer(d)
+	defer tm.Stop()
+	select {
+	case <-tm.C():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                   { return time.Now() }
+func (systemClock) NewTimer(d time.Duration) Timer   { return sysTimer{time.NewTimer(d)} }
+func (systemClock) NewTicker(d time.Duration) Ticker { return sysTicker{time.NewTicker(d)} }
+
+type sysTimer struct{ *time.Timer }
+
+func (t sysTimer) C() <-chan time.Time { return t.Timer.C }
+
+type sysTicker struct{ *time.Ticker }
+
+func (t sysTicker) C() <-chan time.Time { return t.Ticker.C }
+
+// NewManualClock returns a Clock that only moves when Advance or Set are called.
+func NewManualClock(now time.Time) *ManualClock {
+	c := &ManualClock{now: now}
+	c.cond.L = &c.mux
+	return c
+}
+
+// ManualClock is a fake Clock for tests.
+type ManualClock struct {
+	mux    sync.Mutex
+	cond   sync.Cond
+	now    time.Time
+	timers []*manualTimer
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.now
+}
+
+func (c *ManualClock) NewTimer(d time.Duration) Timer {
+	t := &manualTimer{c: c, ch: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+func (c *ManualClock) NewTicker(d time.Duration) Ticker {
+	if d < 1 {
+		panic("non-positive interval for ManualClock.NewTicker")
+	}
+	t := &manualTimer{c: c, ch: make(chan time.Time, 1), period: d}
+	t.Reset(d)
+	return manualTicker{t}
+}
+
+// Advance moves the clock forward by d, firing any timers and tickers that are due on the way.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mux.Lock()
+	c.setLocked(c.now.Add(d))
+	c.mux.Unlock()
+}
+
+// Set moves the clock to now, firing any timers and tickers that are due.
+func (c *ManualClock) Set(now time.Time) {
+	c.mux.Lock()
+	c.setLocked(now)
+	c.mux.Unlock()
+}
+
+// Waiters returns the number of active timers and tickers.
+func (c *ManualClock) Waiters() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return len(c.timers)
+}
+
+// BlockUntil blocks until there are at least n active timers and tickers,
+// which is useful to make sure a goroutine is waiting on the clock before calling Advance.
+func (c *ManualClock) BlockUntil(n int) {
+	c.mux.Lock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+	c.mux.Unlock()
+}
+
+func (c *ManualClock) setLocked(now time.Time) {
+	for {
+		var due *manualTimer
+		for _, t := range c.timers {
+			if !t.when.After(now) && (due == nil || t.when.Before(due.when)) {
+				due = t
+			}
+		}
+		if due == nil {
+			break
+		}
+		c.now = due.when
+		due.fire(now)
+	}
+	c.now = now
+	c.cond.Broadcast()
+}
+
+func (c *ManualClock) addLocked(t *manualTimer) {
+	for _, ot := range c.timers {
+		if ot == t {
+			return
+		}
+	}
+	c.timers = append(c.timers, t)
+	c.cond.Broadcast()
+}
+
+func (c *ManualClock) removeLocked(t *manualTimer) bool {
+	for i, ot := range c.timers {
+		if ot == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			c.cond.Broadcast()
+			return true
+		}
+	}
+	return false
+}
+
+type manualTimer struct {
+	c      *ManualClock
+	ch     chan time.Time
+	when   time.Time
+	period time.Duration
+}
+
+func (t *manualTimer) C() <-chan time.Time { return t.ch }
+
+func (t *manualTimer) Stop() bool {
+	t.c.mux.Lock()
+	defer t.c.mux.Unlock()
+	return t.c.removeLocked(t)
+}
+
+func (t *manualTimer) Reset(d time.Duration) bool {
+	t.c.mux.Lock()
+	defer t.c.mux.Unlock()
+	active := t.c.removeLocked(t)
+	t.when = t.c.now.Add(d)
+	if d < 1 {
+		t.fire(t.c.now)
+	} else {
+		t.c.addLocked(t)
+	}
+	return active
+}
+
+type manualTicker struct{ t *manualTimer }
+
+func (t manualTicker) C() <-chan time.Time { return t.t.ch }
+func (t manualTicker) Stop()               { t.t.Stop() }
+
+// fire must be called with the clock locked, ticks missed before now are dropped like time.Ticker does.
+func (t *manualTimer) fire(now time.Time) {
+	select {
+	case t.ch <- t.when:
+	default:
+	}
+
+	if t.period == 0 {
+		t.c.removeLocked(t)
+		return
+	}
+
+	if !t.when.After(now) {
+		t.when = t.when.Add((now.Sub(t.when)/t.period + 1) * t.period)
+	}
+	t.c.addLocked(t)
+}
@@ -0,0 +1,50 @@
+package otk
+
+import (
+	"testing"
+	"time"
+)
+
+func TestManualClock(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := NewManualClock(start)
+
+	tm := clk.NewTimer(time.Hour)
+	tk := clk.NewTicker(time.Minute)
+	defer tk.Stop()
+
+	if n := clk.Waiters(); n != 2 {
+		t.Fatalf("expected 2 waiters, got %d", n)
+	}
+
+	clk.Advance(59 * time.Minute)
+	select {
+	case <-tm.C():
+		t.Fatal("timer fired early")
+	case now := <-tk.C():
+		if exp := start.Add(time.Minute); !now.Equal(exp) {
+			t.Fatalf("expected the first tick at %v, got %v", exp, now)
+		}
+	}
+
+	select {
+	case <-tk.C():
+		t.Fatal("missed ticks should be dropped")
+	default:
+	}
+
+	clk.Advance(time.Minute)
+	if now := <-tm.C(); !now.Equal(start.Add(time.Hour)) {
+		t.Fatalf("unexpected timer time: %v", now)
+	}
+	if tm.Stop() {
+		t.Fatal("expected Stop to return false on a fired timer")
+	}
+
+	if tm.Reset(time.Second); !tm.Stop() {
+		t.Fatal("expected Stop to return true on an active timer")
+	}
+	if n := clk.Waiters(); n != 1 {
+		t.Fatalf("expected 1 waiter, got %d", n)
+	}
+}
@@ -2,20 +2,29 @@ package otk
 
 import (
 	"context"
+	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"go.oneofone.dev/genh"
-	"go.oneofone.dev/oerrs"
+	"golang.org/x/xerrors"
 )
 
-func NewCloser(onClose func(name string, took time.Duration)) *Closer {
-	ctx, cfn := context.WithCancel(context.Background())
+// NewCloser returns a new Closer, onClose is called after every closer returns or times out.
+func NewCloser(onClose func(name string, took time.Duration, err error)) *Closer {
 	if onClose == nil {
-		onClose = func(name string, took time.Duration) {}
+		onClose = func(name string, took time.Duration, err error) {}
 	}
+	return newCloser(context.Background(), onClose)
+}
+
+func newCloser(ctx context.Context, onClose func(name string, took time.Duration, err error)) *Closer {
+	ctx, cfn := context.WithCancel(ctx)
 	return &Closer{
 		ctx:     ctx,
 		cfn:     cfn,
@@ -24,31 +33,189 @@ func NewCloser(onClose func(name string, took time.Duration)) *Closer {
 }
 
 type closerFn struct {
-	fn   func() error
-	name string
+	fn      func(ctx context.Context) error
+	name    string
+	id      int
+	after   []int
+	mode    closerMode
+	timeout time.Duration
+}
+
+type closerMode uint8
+
+const (
+	closerAfterDeps closerMode = iota
+	closerSync
+	closerAsync
+)
+
+// CloserOptions is used by AddWithOptions.
+type CloserOptions struct {
+	// After lists closers that have to finish before this one starts, they must already be added.
+	After []string
+
+	// Timeout is how long Close waits for the closer before moving on, 0 means no limit besides Close's context.
+	Timeout time.Duration
 }
 
 type Closer struct {
-	ctx     context.Context
-	cfn     func()
-	onClose func(name string, took time.Duration)
-	fns     []closerFn
-	fnsSync []closerFn
-	mux     sync.Mutex
+	ctx      context.Context
+	cfn      func()
+	onClose  func(name string, took time.Duration, err error)
+	fns      []closerFn
+	lastID   int
+	timeout  time.Duration
+	timedOut []string
+	mux      sync.Mutex
+
+	forceExit bool
+	exitCode  int
+
+	parent   *Closer
+	parentID int
+
+	draining   atomic.Bool
+	drainDelay atomic.Int64
+}
+
+// CloserError is a closer that failed, timed out or was skipped.
+type CloserError struct {
+	Name     string
+	Took     time.Duration
+	TimedOut bool
+	Err      error
+}
+
+func (e *CloserError) Error() string {
+	return fmt.Sprintf("closer %s (%v): %v", e.Name, e.Took, e.Err)
 }
 
+func (e *CloserError) Unwrap() error { return e.Err }
+
+// ShutdownError is returned by Close if any of the closers failed.
+type ShutdownError struct {
+	Errors []*CloserError
+}
+
+func (e *ShutdownError) Error() string {
+	return MergeErrors(" | ", e.Unwrap()...).Error()
+}
+
+func (e *ShutdownError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// Closer returns the error of the named closer, or nil.
+func (e *ShutdownError) Closer(name string) *CloserError {
+	for _, err := range e.Errors {
+		if err.Name == name {
+			return err
+		}
+	}
+	return nil
+}
+
+// Shutdowner is implemented by *http.Server among others.
+type Shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// Add adds a closer, sync closers run one after another in the order they were added,
+// then the other ones run concurrently.
 func (c *Closer) Add(name string, fn func() error, sync bool) error {
+	mode := closerAsync
+	if sync {
+		mode = closerSync
+	}
+	_, err := c.add(closerFn{name: name, fn: func(context.Context) error { return fn() }, mode: mode})
+	return err
+}
+
+// AddWithOptions adds a closer that runs once all the closers in opts.After are done,
+// closers that don't depend on each other run concurrently.
+func (c *Closer) AddWithOptions(name string, fn func() error, opts *CloserOptions) error {
+	return c.AddCtx(name, func(context.Context) error { return fn() }, opts)
+}
+
+// AddCtx is like AddWithOptions, but fn gets a context that's done when the closer times out.
+func (c *Closer) AddCtx(name string, fn func(ctx context.Context) error, opts *CloserOptions) error {
+	_, err := c.addCtx(name, fn, opts)
+	return err
+}
+
+func (c *Closer) addCtx(name string, fn func(ctx context.Context) error, opts *CloserOptions) (int, error) {
+	cfn := closerFn{name: name, fn: fn}
+	if opts == nil {
+		return c.add(cfn)
+	}
+	cfn.timeout = opts.Timeout
+
+	c.mux.Lock()
+	for _, dep := range opts.After {
+		found := false
+		for _, f := range c.fns {
+			if f.name == dep {
+				cfn.after = append(cfn.after, f.id)
+				found = true
+			}
+		}
+
+		if !found {
+			c.mux.Unlock()
+			return 0, xerrors.Errorf("closer %s: unknown dependency %s", name, dep)
+		}
+	}
+	c.mux.Unlock()
+	return c.add(cfn)
+}
+
+// AddShutdowner adds s.Shutdown as a closer, it gets Close's context or the closer's timeout.
+func (c *Closer) AddShutdowner(name string, s Shutdowner, opts *CloserOptions) error {
+	return c.AddCtx(name, s.Shutdown, opts)
+}
+
+// AddHTTPServer adds srv.Shutdown as a closer, a closer's timeout is a good idea since Shutdown waits for idle connections.
+func (c *Closer) AddHTTPServer(name string, srv *http.Server, opts *CloserOptions) error {
+	return c.AddShutdowner(name, srv, opts)
+}
+
+// Child returns a new Closer that's closed as part of c's shutdown under name, its Context is derived from c's.
+// It can also be closed on its own, which removes it from c.
+func (c *Closer) Child(name string, opts *CloserOptions) (*Closer, error) {
+	child := newCloser(c.ctx, func(cname string, took time.Duration, err error) {
+		c.onClose(name+"/"+cname, took, err)
+	})
+	child.parent = c
+
+	id, err := c.addCtx(name, func(ctx context.Context) error {
+		if err := child.close(ctx); err != os.ErrClosed {
+			return err
+		}
+		// already closed on its own
+		return nil
+	}, opts)
+	if err != nil {
+		child.cfn()
+		return nil, err
+	}
+	child.parentID = id
+	return child, nil
+}
+
+func (c *Closer) add(cfn closerFn) (int, error) {
 	c.mux.Lock()
 	defer c.mux.Unlock()
 	if c.cfn == nil {
-		return os.ErrClosed
+		return 0, os.ErrClosed
 	}
-	if sync {
-		c.fnsSync = append(c.fnsSync, closerFn{name: name, fn: fn})
-	} else {
-		c.fns = append(c.fns, closerFn{name: name, fn: fn})
-	}
-	return nil
+	c.lastID++
+	cfn.id = c.lastID
+	c.fns = append(c.fns, cfn)
+	return cfn.id, nil
 }
 
 func (c *Closer) Delete(name string) error {
@@ -60,48 +227,259 @@ func (c *Closer) Delete(name string) error {
 	c.fns = genh.Filter(c.fns, func(cfn closerFn) (keep bool) {
 		return cfn.name != name
 	}, true)
-	c.fnsSync = genh.Filter(c.fns, func(cfn closerFn) (keep bool) {
-		return cfn.name != name
-	}, true)
 	return nil
 }
 
-func (c *Closer) Close() error {
+func (c *Closer) deleteID(id int) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.cfn == nil {
+		return
+	}
+	c.fns = genh.Filter(c.fns, func(cfn closerFn) (keep bool) {
+		return cfn.id != id
+	}, true)
+}
+
+// Context returns a context that's canceled as soon as Close starts.
+func (c *Closer) Context() context.Context {
+	return c.ctx
+}
+
+// Draining reports whether Close has started.
+func (c *Closer) Draining() bool {
+	return c.draining.Load()
+}
+
+// SetDrainDelay makes Close wait for d after it starts draining and before running the closers,
+// so load balancers have time to see the readiness check fail.
+func (c *Closer) SetDrainDelay(d time.Duration) {
+	c.drainDelay.Store(int64(d))
+}
+
+// ReadinessHandler responds with 200 until Close starts, then with 503.
+func (c *Closer) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.Draining() {
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+}
+
+// SetTimeout sets the overall deadline used by Wait and WaitSignal when they call Close.
+func (c *Closer) SetTimeout(d time.Duration) {
+	c.mux.Lock()
+	c.timeout = d
+	c.mux.Unlock()
+}
+
+// Close marks the Closer as draining, cancels Context, waits for the drain delay, then runs all the closers.
+// Phases that didn't start before ctx is done are skipped and closers that are still running are abandoned, see TimedOut.
+func (c *Closer) Close(ctx context.Context) error {
+	err := c.close(ctx)
+	if c.parent != nil && err != os.ErrClosed {
+		// after close returns so we don't hold both locks while the parent is closing us
+		c.parent.deleteID(c.parentID)
+	}
+	return err
+}
+
+func (c *Closer) close(ctx context.Context) error {
 	c.mux.Lock()
 	defer c.mux.Unlock()
 	if c.cfn == nil {
 		return os.ErrClosed
 	}
+	c.draining.Store(true)
 	c.cfn()
 	c.cfn = nil
-	var wg sync.WaitGroup
-	errs := oerrs.NewSafeList(false)
-	for _, cfn := range c.fnsSync {
-		start := time.Now()
-		if err := cfn.fn(); err != nil {
-			errs.Errorf("error closing %s: %v", cfn.name, err)
-		}
-
-		c.onClose(cfn.name, time.Since(start))
-	}
-	for _, cfn := range c.fns {
-		wg.Add(1)
-		go func(cfn closerFn) {
-			defer wg.Done()
-			start := time.Now()
-			if err := cfn.fn(); err != nil {
-				errs.Errorf("error closing %s: %v", cfn.name, err)
+
+	if d := time.Duration(c.drainDelay.Load()); d > 0 {
+		tm := time.NewTimer(d)
+		select {
+		case <-tm.C:
+		case <-ctx.Done():
+			tm.Stop()
+		}
+	}
+
+	var (
+		emux sync.Mutex
+		serr ShutdownError
+	)
+	done := func(cfn closerFn, took time.Duration, timedOut bool, err error) {
+		if err != nil {
+			emux.Lock()
+			serr.Errors = append(serr.Errors, &CloserError{Name: cfn.name, Took: took, TimedOut: timedOut, Err: err})
+			if timedOut {
+				c.timedOut = append(c.timedOut, cfn.name)
 			}
-			c.onClose(cfn.name, time.Since(start))
-		}(cfn)
+			emux.Unlock()
+		}
+		c.onClose(cfn.name, took, err)
 	}
-	wg.Wait()
 
-	return errs.Err()
+	for _, phase := range c.phases() {
+		var wg sync.WaitGroup
+		for _, cfn := range phase {
+			if err := ctx.Err(); err != nil {
+				done(cfn, 0, true, xerrors.Errorf("skipped: %w", err))
+				continue
+			}
+
+			wg.Add(1)
+			go func(cfn closerFn) {
+				defer wg.Done()
+				start := time.Now()
+				timedOut, err := c.run(ctx, cfn)
+				done(cfn, time.Since(start), timedOut, err)
+			}(cfn)
+		}
+		wg.Wait()
+	}
+
+	if len(serr.Errors) == 0 {
+		return nil
+	}
+	return &serr
+}
+
+func (c *Closer) run(ctx context.Context, cfn closerFn) (timedOut bool, err error) {
+	if cfn.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfn.timeout)
+		defer cancel()
+	}
+
+	ch := make(chan error, 1)
+	go func() { ch <- cfn.fn(ctx) }()
+
+	select {
+	case err = <-ch:
+	case <-ctx.Done():
+		// it might have returned right at the deadline
+		select {
+		case err = <-ch:
+		default:
+			return true, xerrors.Errorf("timed out: %w", ctx.Err())
+		}
+	}
+	return false, err
 }
 
+// TimedOut returns the names of the closers that were skipped or abandoned by the last Close.
+func (c *Closer) TimedOut() []string {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return append([]string(nil), c.timedOut...)
+}
+
+// phases groups the closers so each one comes after all its dependencies,
+// sync closers depend on the one added before them and the other Add closers depend on all the sync ones.
+func (c *Closer) phases() (out [][]closerFn) {
+	byID := make(map[int]int, len(c.fns))
+	prevSync := map[int][]int{}
+	var syncIDs []int
+	for i, cfn := range c.fns {
+		byID[cfn.id] = i
+		if cfn.mode == closerSync {
+			if len(syncIDs) > 0 {
+				prevSync[cfn.id] = syncIDs[len(syncIDs)-1:]
+			}
+			syncIDs = append(syncIDs, cfn.id)
+		}
+	}
+
+	levels := make([]int, len(c.fns))
+	var level func(i int) int
+	level = func(i int) int {
+		if levels[i] > 0 {
+			return levels[i] - 1
+		}
+
+		cfn := &c.fns[i]
+		deps := cfn.after
+		switch cfn.mode {
+		case closerSync:
+			deps = prevSync[cfn.id]
+		case closerAsync:
+			deps = syncIDs
+		}
+
+		var lvl int
+		for _, id := range deps {
+			// deleted dependencies are ignored
+			if j, ok := byID[id]; ok {
+				if l := level(j) + 1; l > lvl {
+					lvl = l
+				}
+			}
+		}
+		levels[i] = lvl + 1
+		return lvl
+	}
+
+	for i := range c.fns {
+		lvl := level(i)
+		for len(out) <= lvl {
+			out = append(out, nil)
+		}
+		out[lvl] = append(out[lvl], c.fns[i])
+	}
+	return
+}
+
+// osExit is replaced in tests.
+var osExit = os.Exit
+
+// SetForceExit makes WaitSignal call os.Exit(code) if another signal arrives while closing.
+func (c *Closer) SetForceExit(code int) {
+	c.mux.Lock()
+	c.forceExit, c.exitCode = true, code
+	c.mux.Unlock()
+}
+
+// WaitSignal waits for one of the signals, os.Interrupt and SIGTERM if none are passed, then calls Close.
 func (c *Closer) WaitSignal(signals ...os.Signal) error {
-	ctx, _ := signal.NotifyContext(c.ctx, signals...)
+	if len(signals) == 0 {
+		// not every signal, the runtime sends itself SIGURG to preempt goroutines
+		signals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals...)
+	defer signal.Stop(ch)
+
+	c.mux.Lock()
+	force, code := c.forceExit, c.exitCode
+	c.mux.Unlock()
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ch:
+			cancel()
+		case <-ctx.Done():
+		}
+
+		if !force {
+			return
+		}
+
+		select {
+		case <-ch:
+			osExit(code)
+		case <-done:
+		}
+	}()
+
 	return c.Wait(ctx)
 }
 
@@ -110,5 +488,16 @@ func (c *Closer) Wait(ctx context.Context) error {
 	case <-ctx.Done():
 	case <-c.ctx.Done():
 	}
-	return c.Close()
+
+	c.mux.Lock()
+	timeout := c.timeout
+	c.mux.Unlock()
+
+	cctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		cctx, cancel = context.WithTimeout(cctx, timeout)
+		defer cancel()
+	}
+	return c.Close(cctx)
 }
@@ -1,7 +1,16 @@
 package otk
 
 import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -21,7 +30,7 @@ func (c *closable) Close() error {
 func TestCloser(t *testing.T) {
 	var cc closable
 	var closed genh.LSlice[string]
-	c := NewCloser(func(name string, took time.Duration) {
+	c := NewCloser(func(name string, took time.Duration, err error) {
 		closed.Append(name)
 		// t.Logf("closed %s in %s", name, took)
 	})
@@ -29,7 +38,7 @@ func TestCloser(t *testing.T) {
 		cc.i.Add(1)
 		c.Add("closable:"+strconv.Itoa(i), cc.Close, i%2 == 0)
 	}
-	if err := c.Close(); err != nil {
+	if err := c.Close(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 	syncExpected := []string{"closable:0", "closable:2", "closable:4", "closable:6", "closable:8"}
@@ -39,3 +48,180 @@ func TestCloser(t *testing.T) {
 		}
 	}
 }
+
+func TestCloserDeps(t *testing.T) {
+	var closed genh.LSlice[string]
+	c := NewCloser(func(name string, took time.Duration, err error) { closed.Append(name) })
+	add := func(name string, after ...string) {
+		t.Helper()
+		if err := c.AddWithOptions(name, func() error { return nil }, &CloserOptions{After: after}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	add("http")
+	add("grpc")
+	add("workers", "http", "grpc")
+	add("cache")
+	add("db", "workers", "cache")
+	c.Add("legacy", func() error { return nil }, true)
+
+	if err := c.AddWithOptions("x", nil, &CloserOptions{After: []string{"nope"}}); err == nil {
+		t.Fatal("expected an unknown dependency error")
+	}
+
+	if err := c.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	pos := map[string]int{}
+	for i, name := range closed.Raw() {
+		pos[name] = i
+	}
+	if len(pos) != 6 || pos["workers"] < pos["http"] || pos["workers"] < pos["grpc"] || pos["db"] < pos["workers"] || pos["db"] < pos["cache"] {
+		t.Fatalf("unexpected close order: %v", closed.Raw())
+	}
+}
+
+func TestCloserTimeout(t *testing.T) {
+	var (
+		mux  sync.Mutex
+		errs = map[string]error{}
+	)
+	c := NewCloser(func(name string, took time.Duration, err error) {
+		mux.Lock()
+		errs[name] = err
+		mux.Unlock()
+	})
+
+	hang := make(chan struct{})
+	defer close(hang)
+	c.AddWithOptions("hung", func() error { <-hang; return nil }, &CloserOptions{Timeout: 10 * time.Millisecond})
+	c.AddCtx("ctx", func(ctx context.Context) error {
+		if _, ok := ctx.Deadline(); !ok {
+			return errors.New("expected a deadline")
+		}
+		return nil
+	}, &CloserOptions{Timeout: time.Second})
+	c.AddWithOptions("slow", func() error { <-hang; return nil }, &CloserOptions{After: []string{"hung"}})
+	c.AddWithOptions("db", func() error { return nil }, &CloserOptions{After: []string{"slow"}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := c.Close(ctx)
+	var se *ShutdownError
+	if !errors.As(err, &se) || len(se.Errors) != 3 {
+		t.Fatalf("expected a ShutdownError, got %v", err)
+	}
+	if ce := se.Closer("hung"); ce == nil || !ce.TimedOut || ce.Took < 10*time.Millisecond || !errors.Is(ce, context.DeadlineExceeded) {
+		t.Fatalf("unexpected hung closer error: %#v", ce)
+	}
+	if se.Closer("ctx") != nil {
+		t.Fatalf("unexpected ctx closer error: %v", se.Closer("ctx"))
+	}
+
+	if to := c.TimedOut(); !reflect.DeepEqual(to, []string{"hung", "slow", "db"}) {
+		t.Fatalf("unexpected timed out closers: %v", to)
+	}
+	if !errors.Is(errs["hung"], context.DeadlineExceeded) || errs["ctx"] != nil || !strings.Contains(errs["db"].Error(), "skipped") {
+		t.Fatalf("unexpected closer errors: %v", errs)
+	}
+}
+
+func TestCloserHTTP(t *testing.T) {
+	c := NewCloser(nil)
+	c.SetDrainDelay(20 * time.Millisecond)
+
+	ready := httptest.NewServer(c.ReadinessHandler())
+	defer ready.Close()
+
+	srv := &http.Server{Handler: http.NotFoundHandler()}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	if err := c.AddHTTPServer("http", srv, &CloserOptions{Timeout: time.Second}); err != nil {
+		t.Fatal(err)
+	}
+
+	status := func() int {
+		resp, err := http.Get(ready.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if st := status(); st != http.StatusOK || c.Draining() {
+		t.Fatalf("expected to be ready, got %d", st)
+	}
+
+	done := make(chan error)
+	go func() { done <- c.Close(context.Background()) }()
+	<-c.Context().Done()
+	if st := status(); st != http.StatusServiceUnavailable || !c.Draining() {
+		t.Fatalf("expected to be draining, got %d", st)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := http.Get("http://" + ln.Addr().String()); err == nil {
+		t.Fatal("expected the server to be shut down")
+	}
+}
+
+func TestCloserErrors(t *testing.T) {
+	errFail := errors.New("fail")
+	c := NewCloser(nil)
+	c.Add("ok", func() error { return nil }, true)
+	c.Add("fail", func() error { return errFail }, false)
+
+	err := c.Close(context.Background())
+	var ce *CloserError
+	if !errors.Is(err, errFail) || !errors.As(err, &ce) || ce.Name != "fail" || ce.TimedOut {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+	if err := c.Close(context.Background()); err != os.ErrClosed {
+		t.Fatalf("expected os.ErrClosed, got %v", err)
+	}
+}
+
+func TestCloserChild(t *testing.T) {
+	var closed genh.LSlice[string]
+	c := NewCloser(func(name string, took time.Duration, err error) { closed.Append(name) })
+	c.Add("db", func() error { return nil }, false)
+
+	lib, err := c.Child("lib", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lib.Add("conn", func() error { return nil }, false)
+
+	tenant, _ := c.Child("tenant", nil)
+	var tenantClosed atomic.Int64
+	tenant.Add("cache", func() error { tenantClosed.Add(1); return nil }, false)
+	if err := tenant.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if lib.Context().Err() == nil || !lib.Draining() {
+		t.Fatal("expected the child to be closed")
+	}
+	if n := tenantClosed.Load(); n != 1 {
+		t.Fatalf("expected the tenant to be closed once, got %d", n)
+	}
+
+	pos := map[string]int{}
+	for i, name := range closed.Raw() {
+		pos[name] = i
+	}
+	if _, ok := pos["tenant"]; ok || pos["lib/conn"] > pos["lib"] || len(pos) != 4 {
+		t.Fatalf("unexpected close order: %v", closed.Raw())
+	}
+}
@@ -0,0 +1,78 @@
+//go:build unix
+
+package otk
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCloserForceExit(t *testing.T) {
+	exited := make(chan int, 1)
+	osExit = func(code int) { exited <- code }
+	defer func() { osExit = os.Exit }()
+
+	c := NewCloser(nil)
+	c.SetForceExit(3)
+	release := make(chan struct{})
+	c.Add("hung", func() error { <-release; return nil }, false)
+
+	done := make(chan error)
+	go func() { done <- c.WaitSignal(syscall.SIGUSR1) }()
+
+	// keeps the signal from killing the test if it's sent before WaitSignal is listening
+	signal.Notify(make(chan os.Signal, 1), syscall.SIGUSR1)
+	for c.Context().Err() == nil {
+		syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+		time.Sleep(time.Millisecond)
+	}
+	syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+
+	if code := <-exited; code != 3 {
+		t.Fatalf("expected exit code 3, got %d", code)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCloserDefaultSignals(t *testing.T) {
+	exited := make(chan int, 1)
+	osExit = func(code int) { exited <- code }
+	defer func() { osExit = os.Exit }()
+
+	c := NewCloser(nil)
+	c.SetForceExit(3)
+
+	done := make(chan error)
+	go func() { done <- c.WaitSignal() }()
+
+	// the runtime uses SIGURG for preemption, it must not start closing nor force an exit
+	for i := 0; i < 20; i++ {
+		syscall.Kill(os.Getpid(), syscall.SIGURG)
+		time.Sleep(time.Millisecond)
+	}
+	if err := c.Context().Err(); err != nil {
+		t.Fatalf("expected SIGURG to be ignored, got %v", err)
+	}
+	select {
+	case code := <-exited:
+		t.Fatalf("unexpected exit with code %d", code)
+	default:
+	}
+
+	guard := make(chan os.Signal, 1)
+	signal.Notify(guard, syscall.SIGTERM)
+	defer signal.Stop(guard)
+	for c.Context().Err() == nil {
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+		time.Sleep(time.Millisecond)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -4,8 +4,11 @@ import (
 	"archive/tar"
 	"archive/zip"
 	"bufio"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
@@ -18,8 +21,37 @@ type TarOptions struct {
 	FilterFn      func(path string, fi os.FileInfo) bool
 	BufSize       int
 	DeleteOnError bool
+
+	// Preserve keeps directories, symlinks, hard links, permissions, mod times and,
+	// when extracting as root, ownership, otherwise only regular files are stored and extracted.
+	Preserve bool
+
+	// Untar limits, 0 means no limit.
+	MaxEntries  int
+	MaxSize     int64
+	MaxFileSize int64
+}
+
+var (
+	// ErrUnsafePath is returned by Untar for entries that would be extracted outside the destination folder.
+	ErrUnsafePath = errors.New("unsafe path")
+	// ErrTarLimit matches all the *TarLimitError errors.
+	ErrTarLimit = errors.New("tar limit exceeded")
+)
+
+// TarLimitError is returned by Untar when the archive exceeds one of the TarOptions limits.
+type TarLimitError struct {
+	Name  string // the entry that went over the limit
+	Limit string // MaxEntries, MaxSize or MaxFileSize
+	Max   int64
+}
+
+func (e *TarLimitError) Error() string {
+	return fmt.Sprintf("%s: %s of %d exceeded", e.Name, e.Limit, e.Max)
 }
 
+func (e *TarLimitError) Is(target error) bool { return target == ErrTarLimit }
+
 func TarFolder(folder, fp string, opts *TarOptions) (err error) {
 	if opts == nil {
 		opts = &TarOptions{}
@@ -72,9 +104,13 @@ func Tar(folder string, w io.Writer, opts *TarOptions) (err error) {
 
 	ffn := opts.FilterFn
 	if ffn == nil {
-		ffn = func(_ string, fi os.FileInfo) bool { return fi.IsDir() || fi.Mode().IsRegular() }
+		ffn = func(_ string, fi os.FileInfo) bool {
+			return fi.IsDir() || fi.Mode().IsRegular() || (opts.Preserve && fi.Mode()&os.ModeSymlink != 0)
+		}
 	}
 
+	links := map[fileKey]string{}
+
 	err = filepath.Walk(folder, func(path string, fi os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -88,11 +124,16 @@ func Tar(folder string, w io.Writer, opts *TarOptions) (err error) {
 			return nil
 		}
 
-		if !fi.Mode().IsRegular() {
-			return nil
+		if opts.Preserve {
+			if p == "." {
+				return nil
+			}
+			err = appendEntryToTar(tw, path, filepath.ToSlash(p), fi, links)
+		} else if fi.Mode().IsRegular() {
+			err = AppendToTar(tw, path, p)
 		}
 
-		if err = AppendToTar(tw, path, p); err != nil {
+		if err != nil {
 			err = xerrors.Errorf("tar error (%s): %w", path, err)
 		}
 		return err
@@ -130,6 +171,50 @@ func AppendToTar(tw *tar.Writer, fullPath, tarPath string) (err error) {
 	return
 }
 
+// appendEntryToTar adds a directory, symlink, hard link or regular file, other types are skipped.
+func appendEntryToTar(tw *tar.Writer, fullPath, tarPath string, fi os.FileInfo, links map[fileKey]string) (err error) {
+	var hdr *tar.Header
+	switch {
+	case fi.IsDir():
+		if hdr, err = tar.FileInfoHeader(fi, ""); err != nil {
+			return
+		}
+		hdr.Name = tarPath + "/"
+
+	case fi.Mode()&os.ModeSymlink != 0:
+		var link string
+		if link, err = os.Readlink(fullPath); err != nil {
+			return
+		}
+		if hdr, err = tar.FileInfoHeader(fi, link); err != nil {
+			return
+		}
+		hdr.Name = tarPath
+
+	case fi.Mode().IsRegular():
+		key, ok := fileKeyOf(fi)
+		if !ok {
+			return AppendToTar(tw, fullPath, tarPath)
+		}
+
+		first, ok := links[key]
+		if !ok {
+			links[key] = tarPath
+			return AppendToTar(tw, fullPath, tarPath)
+		}
+
+		if hdr, err = tar.FileInfoHeader(fi, ""); err != nil {
+			return
+		}
+		hdr.Name, hdr.Typeflag, hdr.Linkname, hdr.Size = tarPath, tar.TypeLink, first, 0
+
+	default:
+		return nil
+	}
+
+	return tw.WriteHeader(hdr)
+}
+
 func UntarFolder(fp, folder string, opts *TarOptions) error {
 	f, err := os.Open(fp)
 	if err != nil {
@@ -139,38 +224,242 @@ func UntarFolder(fp, folder string, opts *TarOptions) error {
 	return Untar(f, folder, opts)
 }
 
+// Untar extracts r into folder, entries that would end up outside of it, directly or through symlinks, abort with ErrUnsafePath,
+// and going over the limits in opts aborts with a *TarLimitError, what was extracted up to that point is left as is.
 func Untar(r io.Reader, folder string, opts *TarOptions) error {
+	if opts == nil {
+		opts = &TarOptions{}
+	}
+
 	r = bufio.NewReader(r)
-	if opts != nil && opts.UncompressFn != nil {
+	if opts.UncompressFn != nil {
 		r = opts.UncompressFn(r)
 	}
 	rd := tar.NewReader(r)
 
+	type dirEntry struct {
+		p   string
+		hdr *tar.Header
+	}
+
+	var (
+		// directories get their permissions and times last, so they're writable and their mod times don't change
+		dirs     []dirEntry
+		symlinks []string
+		chown    = opts.Preserve && os.Geteuid() == 0
+
+		entries int
+		size    int64
+	)
+
 	for {
 		hdr, err := rd.Next()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			if err == io.EOF {
-				err = nil
-			}
 			return err
 		}
-		if hdr.Typeflag != tar.TypeReg {
+
+		if entries++; opts.MaxEntries > 0 && entries > opts.MaxEntries {
+			return &TarLimitError{Name: hdr.Name, Limit: "MaxEntries", Max: int64(opts.MaxEntries)}
+		}
+
+		if !opts.Preserve && hdr.Typeflag != tar.TypeReg {
 			continue
 		}
-		p := filepath.Join(folder, hdr.Name)
 
-		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		if hdr.Typeflag == tar.TypeReg {
+			if opts.MaxFileSize > 0 && hdr.Size > opts.MaxFileSize {
+				return &TarLimitError{Name: hdr.Name, Limit: "MaxFileSize", Max: opts.MaxFileSize}
+			}
+			if size += hdr.Size; opts.MaxSize > 0 && size > opts.MaxSize {
+				return &TarLimitError{Name: hdr.Name, Limit: "MaxSize", Max: opts.MaxSize}
+			}
+		}
+
+		var p string
+		if hdr.Typeflag == tar.TypeDir {
+			p, err = resolveInside(folder, hdr.Name, true)
+		} else {
+			p, err = resolveInside(folder, hdr.Name, false)
+		}
+		if err != nil {
 			return err
 		}
 
-		if err = CopyOnWriteFile(p, func(w io.Writer) error {
-			_, err := io.Copy(w, rd)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(p, 0o755); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirEntry{p, hdr})
+
+		case tar.TypeReg:
+			if err = untarFile(rd, p, hdr, opts.Preserve); err != nil {
+				return err
+			}
+
+		case tar.TypeSymlink, tar.TypeLink:
+			var target string
+			if hdr.Typeflag == tar.TypeSymlink {
+				err = checkSymlink(folder, p, hdr.Linkname)
+			} else {
+				target, err = resolveInside(folder, hdr.Linkname, false)
+			}
+			if err != nil {
+				return xerrors.Errorf("%s -> %s: %w", hdr.Name, hdr.Linkname, err)
+			}
+
+			if err = os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+				return err
+			}
+			os.Remove(p)
+
+			if hdr.Typeflag == tar.TypeSymlink {
+				err = os.Symlink(hdr.Linkname, p)
+				symlinks = append(symlinks, p)
+			} else {
+				err = os.Link(target, p)
+			}
+			if err != nil {
+				return err
+			}
+
+		default:
+			continue
+		}
+
+		if chown {
+			if err = os.Lchown(p, hdr.Uid, hdr.Gid); err != nil {
+				return err
+			}
+		}
+
+		if hdr.Typeflag == tar.TypeReg && opts.Preserve {
+			if err = chtimes(p, hdr); err != nil {
+				return err
+			}
+		}
+	}
+
+	// a symlink can point to another one that didn't exist yet when it was checked
+	for _, p := range symlinks {
+		target, _ := os.Readlink(p)
+		if err := checkSymlink(folder, p, target); err != nil {
+			os.Remove(p)
+			return xerrors.Errorf("%s -> %s: %w", p, target, err)
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		d := dirs[i]
+		if err := os.Chmod(d.p, d.hdr.FileInfo().Mode().Perm()); err != nil {
 			return err
-		}); err != nil {
+		}
+		if err := chtimes(d.p, d.hdr); err != nil {
 			return err
 		}
+	}
+
+	return nil
+}
 
+// checkSymlink returns ErrUnsafePath if a symlink at p pointing to target would lead outside of root.
+func checkSymlink(root, p, target string) error {
+	if filepath.IsAbs(target) {
+		return ErrUnsafePath
+	}
+	dir, err := filepath.Rel(root, filepath.Dir(p))
+	if err != nil {
+		return err
 	}
+	// not path.Join, cleaning it would hide ".." after a symlink
+	_, err = resolveInside(root, filepath.ToSlash(dir)+"/"+filepath.ToSlash(target), true)
+	return err
+}
+
+// resolveInside returns the real path of name under root, following symlinks one component at a time,
+// it returns ErrUnsafePath if it'd go outside of root. The last component is only followed if followLast is set.
+func resolveInside(root, name string, followLast bool) (string, error) {
+	var (
+		cur  string
+		rest = strings.Split(filepath.ToSlash(name), "/")
+		hops int
+	)
+
+	for len(rest) > 0 {
+		part := rest[0]
+		rest = rest[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if cur == "" {
+				return "", xerrors.Errorf("%s: %w", name, ErrUnsafePath)
+			}
+			if cur = path.Dir(cur); cur == "." {
+				cur = ""
+			}
+			continue
+		}
+
+		next := path.Join(cur, part)
+		if len(rest) == 0 && !followLast {
+			cur = next
+			break
+		}
+
+		fi, err := os.Lstat(filepath.Join(root, filepath.FromSlash(next)))
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			// doesn't exist yet or isn't a symlink
+			cur = next
+			continue
+		}
+
+		if hops++; hops > 255 {
+			return "", xerrors.Errorf("%s: too many links: %w", name, ErrUnsafePath)
+		}
+
+		target, err := os.Readlink(filepath.Join(root, filepath.FromSlash(next)))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			return "", xerrors.Errorf("%s: %w", name, ErrUnsafePath)
+		}
+		// the target is relative to the link's folder, which is cur
+		rest = append(strings.Split(filepath.ToSlash(target), "/"), rest...)
+	}
+
+	return filepath.Join(root, filepath.FromSlash(cur)), nil
+}
+
+func chtimes(p string, hdr *tar.Header) error {
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+	return os.Chtimes(p, atime, hdr.ModTime)
+}
+
+func untarFile(rd io.Reader, p string, hdr *tar.Header, preserve bool) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+
+	if !preserve {
+		return CopyOnWriteFile(p, func(w io.Writer) error {
+			_, err := io.Copy(w, rd)
+			return err
+		})
+	}
+
+	return CopyOnWriteFilePerms(p, func(bw *bufio.Writer) error {
+		_, err := io.Copy(bw, rd)
+		return err
+	}, hdr.FileInfo().Mode().Perm())
 }
 
 func Unzip(rt io.ReaderAt, dst string, filter func(path string, f *zip.File) bool) (err error) {
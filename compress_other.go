@@ -0,0 +1,12 @@
+//go:build !unix
+
+package otk
+
+import "os"
+
+type fileKey struct{}
+
+// fileKeyOf always returns false, hard links aren't detected on this platform.
+func fileKeyOf(fi os.FileInfo) (fileKey, bool) {
+	return fileKey{}, false
+}
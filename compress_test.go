@@ -1,10 +1,14 @@
 package otk
 
 import (
+	"archive/tar"
+	"bytes"
+	"errors"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestTarFolder(t *testing.T) {
@@ -27,3 +31,144 @@ func TestTarFolder(t *testing.T) {
 	}
 	t.Log(filepath.Glob(filepath.Join(dp, "*")))
 }
+
+func TestTarPreserve(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	must(os.MkdirAll(filepath.Join(src, "bin"), 0o755))
+	must(os.MkdirAll(filepath.Join(src, "lib", "empty"), 0o700))
+	must(os.WriteFile(filepath.Join(src, "bin", "run"), []byte("#!/bin/sh\n"), 0o755))
+	must(os.WriteFile(filepath.Join(src, "lib", "libx.so.1"), []byte("lib"), 0o644))
+	must(os.Symlink("libx.so.1", filepath.Join(src, "lib", "libx.so")))
+	must(os.Link(filepath.Join(src, "bin", "run"), filepath.Join(src, "bin", "run2")))
+	must(os.Chtimes(filepath.Join(src, "bin", "run"), mtime, mtime))
+
+	var buf bytes.Buffer
+	must(Tar(src, &buf, &TarOptions{Preserve: true}))
+	must(Untar(&buf, dst, &TarOptions{Preserve: true}))
+
+	st, err := os.Stat(filepath.Join(dst, "bin", "run"))
+	must(err)
+	if st.Mode().Perm() != 0o755 || !st.ModTime().Equal(mtime) {
+		t.Fatalf("unexpected mode or mtime: %v %v", st.Mode(), st.ModTime())
+	}
+
+	if link, err := os.Readlink(filepath.Join(dst, "lib", "libx.so")); err != nil || link != "libx.so.1" {
+		t.Fatalf("unexpected symlink: %q %v", link, err)
+	}
+
+	st2, err := os.Stat(filepath.Join(dst, "bin", "run2"))
+	must(err)
+	if !os.SameFile(st, st2) {
+		t.Fatal("expected run2 to be a hard link to run")
+	}
+
+	st, err = os.Stat(filepath.Join(dst, "lib", "empty"))
+	must(err)
+	if !st.IsDir() || st.Mode().Perm() != 0o700 {
+		t.Fatalf("unexpected dir: %v", st.Mode())
+	}
+}
+
+func TestUntarUnsafe(t *testing.T) {
+	type entry struct {
+		name, link string
+		typ        byte
+		size       int
+	}
+
+	mkTar := func(entries ...entry) *bytes.Buffer {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, e := range entries {
+			hdr := &tar.Header{Name: e.name, Linkname: e.link, Typeflag: e.typ, Mode: 0o644, Size: int64(e.size)}
+			if e.typ == tar.TypeDir {
+				hdr.Mode = 0o755
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+			tw.Write(bytes.Repeat([]byte("x"), e.size))
+		}
+		tw.Close()
+		return &buf
+	}
+
+	unsafe := map[string][]entry{
+		"traversal":     {{name: "../evil", typ: tar.TypeReg, size: 1}},
+		"abs symlink":   {{name: "l", link: "/etc", typ: tar.TypeSymlink}},
+		"symlink":       {{name: "a/l", link: "../../outside", typ: tar.TypeSymlink}},
+		"through link":  {{name: "up", link: ".", typ: tar.TypeSymlink}, {name: "up/../evil", typ: tar.TypeReg, size: 1}},
+		"hard link":     {{name: "h", link: "../outside", typ: tar.TypeLink}},
+		"delayed chain": {{name: "t", link: "s/s/s/../x", typ: tar.TypeSymlink}, {name: "s", link: ".", typ: tar.TypeSymlink}},
+	}
+	for name, entries := range unsafe {
+		dst := filepath.Join(t.TempDir(), "dst")
+		if err := Untar(mkTar(entries...), dst, &TarOptions{Preserve: true}); !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("%s: expected ErrUnsafePath, got %v", name, err)
+		}
+	}
+
+	// links are only created with Preserve, but paths are always checked
+	if err := Untar(mkTar(unsafe["traversal"]...), filepath.Join(t.TempDir(), "dst"), nil); !errors.Is(err, ErrUnsafePath) {
+		t.Errorf("traversal without options: expected ErrUnsafePath, got %v", err)
+	}
+
+	// a symlink that was already in the destination can't be used to escape it either
+	root := t.TempDir()
+	dst := filepath.Join(root, "dst")
+	if err := os.MkdirAll(filepath.Join(root, "outside"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dst, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "outside"), filepath.Join(dst, "l")); err != nil {
+		t.Fatal(err)
+	}
+	if err := Untar(mkTar(entry{name: "l/f", typ: tar.TypeReg, size: 1}), dst, nil); !errors.Is(err, ErrUnsafePath) {
+		t.Errorf("pre-existing symlink: expected ErrUnsafePath, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "outside", "f")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be written outside the destination: %v", err)
+	}
+
+	dst = t.TempDir()
+	err := Untar(mkTar(
+		entry{name: "sub", typ: tar.TypeDir},
+		entry{name: "l", link: "sub", typ: tar.TypeSymlink},
+		entry{name: "l/f", typ: tar.TypeReg, size: 3},
+	), dst, &TarOptions{Preserve: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(dst, "sub", "f")); err != nil || string(b) != "xxx" {
+		t.Fatalf("expected the file to be written through the symlink: %q %v", b, err)
+	}
+
+	limits := map[string]*TarOptions{
+		"MaxEntries":  {MaxEntries: 2},
+		"MaxFileSize": {MaxFileSize: 5},
+		"MaxSize":     {MaxSize: 8},
+	}
+	for limit, opts := range limits {
+		err := Untar(mkTar(
+			entry{name: "a", typ: tar.TypeReg, size: 4},
+			entry{name: "b", typ: tar.TypeReg, size: 4},
+			entry{name: "c", typ: tar.TypeReg, size: 6},
+		), t.TempDir(), opts)
+
+		var le *TarLimitError
+		if !errors.Is(err, ErrTarLimit) || !errors.As(err, &le) || le.Limit != limit || le.Name != "c" {
+			t.Errorf("%s: unexpected error: %v", limit, err)
+		}
+	}
+}
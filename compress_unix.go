@@ -0,0 +1,21 @@
+//go:build unix
+
+package otk
+
+import (
+	"os"
+	"syscall"
+)
+
+type fileKey struct {
+	dev, ino uint64
+}
+
+// fileKeyOf returns a key that identifies hard linked files.
+func fileKeyOf(fi os.FileInfo) (fileKey, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		return fileKey{}, false
+	}
+	return fileKey{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
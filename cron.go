@@ -0,0 +1,265 @@
+package otk
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 0 1 1 *",
+	"@annually": "0 0 0 1 1 *",
+	"@monthly":  "0 0 0 1 * *",
+	"@weekly":   "0 0 0 * * 0",
+	"@daily":    "0 0 0 * * *",
+	"@midnight": "0 0 0 * * *",
+	"@hourly":   "0 0 * * * *",
+}
+
+type cronField struct {
+	name     string
+	min, max uint
+	names    map[string]uint
+}
+
+var (
+	cronSeconds = cronField{name: "second", min: 0, max: 59}
+	cronMinutes = cronField{name: "minute", min: 0, max: 59}
+	cronHours   = cronField{name: "hour", min: 0, max: 23}
+	cronDoM     = cronField{name: "day of month", min: 1, max: 31}
+	cronMonths  = cronField{name: "month", min: 1, max: 12, names: map[string]uint{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	cronDoW = cronField{name: "day of week", min: 0, max: 7, names: map[string]uint{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+const cronAllHours = 1<<24 - 1
+
+// CronSchedule is a Schedule parsed from a cron spec, see ParseCron.
+type CronSchedule struct {
+	spec string
+	loc  *time.Location
+
+	sec, min, hour, dom, month, dow uint64
+
+	domStar, dowStar bool
+}
+
+// ParseCron is an alias for ParseCronIn(spec, time.Local).
+func ParseCron(spec string) (*CronSchedule, error) {
+	return ParseCronIn(spec, time.Local)
+}
+
+// ParseCronIn parses a cron spec and evaluates it in loc.
+// Accepts the standard 5 fields (minute, hour, day of month, month, day of week),
+// an optional leading seconds field, or one of @yearly, @annually, @monthly, @weekly, @daily, @midnight and @hourly.
+// The spec can be prefixed with `CRON_TZ=Zone/Name ` (or `TZ=`) to override loc.
+func ParseCronIn(spec string, loc *time.Location) (_ *CronSchedule, err error) {
+	if loc == nil {
+		loc = time.Local
+	}
+
+	cs := &CronSchedule{spec: spec}
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "CRON_TZ=") || strings.HasPrefix(spec, "TZ=") {
+		i := strings.IndexByte(spec, ' ')
+		if i == -1 {
+			return nil, xerrors.Errorf("cron %q: missing fields", cs.spec)
+		}
+		if loc, err = time.LoadLocation(spec[strings.IndexByte(spec, '=')+1 : i]); err != nil {
+			return nil, xerrors.Errorf("cron %q: %w", cs.spec, err)
+		}
+		spec = strings.TrimSpace(spec[i+1:])
+	}
+	cs.loc = loc
+
+	if strings.HasPrefix(spec, "@") {
+		m, ok := cronMacros[spec]
+		if !ok {
+			return nil, xerrors.Errorf("cron %q: unknown macro %s", cs.spec, spec)
+		}
+		spec = m
+	}
+
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return nil, xerrors.Errorf("cron %q: expected 5 or 6 fields, got %d", cs.spec, len(fields))
+	}
+
+	for i, f := range [...]struct {
+		out  *uint64
+		star *bool
+		cf   cronField
+	}{
+		{&cs.sec, nil, cronSeconds},
+		{&cs.min, nil, cronMinutes},
+		{&cs.hour, nil, cronHours},
+		{&cs.dom, &cs.domStar, cronDoM},
+		{&cs.month, nil, cronMonths},
+		{&cs.dow, &cs.dowStar, cronDoW},
+	} {
+		if *f.out, err = f.cf.parse(fields[i]); err != nil {
+			return nil, xerrors.Errorf("cron %q: %w", cs.spec, err)
+		}
+		if f.star != nil {
+			// like vixie cron, `*/2` is still a star for the day of month/week rule
+			*f.star = strings.HasPrefix(fields[i], "*") || fields[i] == "?"
+		}
+	}
+
+	// 7 is an alias for sunday
+	if cs.dow&(1<<7) != 0 {
+		cs.dow = cs.dow&^(1<<7) | 1
+	}
+
+	return cs, nil
+}
+
+func (f *cronField) parse(s string) (bits uint64, err error) {
+	for _, part := range strings.Split(s, ",") {
+		lo, hi, step := f.min, f.max, uint(1)
+
+		rng := part
+		if i := strings.IndexByte(part, '/'); i != -1 {
+			rng = part[:i]
+			if step, err = f.number(part[i+1:], false); err != nil {
+				return
+			}
+			if step == 0 {
+				return 0, xerrors.Errorf("%s: step can't be 0: %q", f.name, part)
+			}
+		}
+
+		switch {
+		case rng == "*" || rng == "?":
+		case strings.IndexByte(rng, '-') != -1:
+			i := strings.IndexByte(rng, '-')
+			if lo, err = f.number(rng[:i], true); err != nil {
+				return
+			}
+			if hi, err = f.number(rng[i+1:], true); err != nil {
+				return
+			}
+		default:
+			if lo, err = f.number(rng, true); err != nil {
+				return
+			}
+			if step == 1 {
+				hi = lo
+			}
+		}
+
+		if lo > hi {
+			return 0, xerrors.Errorf("%s: invalid range: %q", f.name, part)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return
+}
+
+func (f *cronField) number(s string, bounded bool) (uint, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+
+	v, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, xerrors.Errorf("%s: invalid value: %q", f.name, s)
+	}
+
+	if bounded && (uint(v) < f.min || uint(v) > f.max) {
+		return 0, xerrors.Errorf("%s: %d is out of range [%d, %d]", f.name, v, f.min, f.max)
+	}
+	return uint(v), nil
+}
+
+// Location returns the time zone the schedule is evaluated in.
+func (cs *CronSchedule) Location() *time.Location { return cs.loc }
+
+func (cs *CronSchedule) String() string { return cs.spec }
+
+// Next returns the next activation time after t, in the schedule's location.
+// Wall clock times skipped by a DST transition run right after it, and times repeated by one
+// only run once, unless the hour field is `*`, in which case both occurrences run.
+// Returns the zero time if there's no activation in the next 5 years.
+func (cs *CronSchedule) Next(t time.Time) time.Time {
+	// we walk one zone period at a time, within a period the offset is fixed, so the wall clock
+	// is the instant plus the offset, and we match it in UTC, where every day is 24 hours long.
+	from := t.In(cs.loc).Truncate(time.Second).Add(time.Second)
+	limit := from.Year() + 5
+	for from.Year() <= limit {
+		_, off := from.Zone()
+		offset := time.Duration(off) * time.Second
+		start, end := from.ZoneBounds()
+
+		wall := from.UTC().Add(offset)
+		if !start.IsZero() && cs.hour != cronAllHours {
+			// the clock moved back, the repeated wall times already ran before the transition
+			_, prev := start.Add(-time.Second).Zone()
+			if rep := start.UTC().Add(time.Duration(prev) * time.Second); wall.Before(rep) {
+				wall = rep
+			}
+		}
+
+		w, ok := cs.nextWall(wall, limit)
+		if !ok {
+			return time.Time{}
+		}
+
+		c := w.Add(-offset).In(cs.loc)
+		if end.IsZero() || c.Before(end) {
+			return c
+		}
+
+		// skipped by a transition that moved the clock forward, run right after the gap
+		_, next := end.Zone()
+		if w.Before(end.UTC().Add(time.Duration(next) * time.Second)) {
+			return c
+		}
+
+		from = end
+	}
+	return time.Time{}
+}
+
+// nextWall returns the first wall clock time >= w that matches the schedule.
+func (cs *CronSchedule) nextWall(w time.Time, limit int) (time.Time, bool) {
+	for w.Year() <= limit {
+		switch {
+		case cs.month&(1<<uint(w.Month())) == 0:
+			w = time.Date(w.Year(), w.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !cs.dayMatches(w):
+			w = time.Date(w.Year(), w.Month(), w.Day()+1, 0, 0, 0, 0, time.UTC)
+		case cs.hour&(1<<uint(w.Hour())) == 0:
+			w = w.Truncate(time.Hour).Add(time.Hour)
+		case cs.min&(1<<uint(w.Minute())) == 0:
+			w = w.Truncate(time.Minute).Add(time.Minute)
+		case cs.sec&(1<<uint(w.Second())) == 0:
+			w = w.Add(time.Second)
+		default:
+			return w, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (cs *CronSchedule) dayMatches(w time.Time) bool {
+	dom := cs.dom&(1<<uint(w.Day())) != 0
+	dow := cs.dow&(1<<uint(w.Weekday())) != 0
+	if cs.domStar || cs.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
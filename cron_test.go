@@ -0,0 +1,64 @@
+package otk
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	tests := []struct {
+		spec string
+		from string
+		exp  []string
+	}{
+		{"*/15 * * * *", "2024-01-01T00:07:00-05:00", []string{"2024-01-01T00:15:00-05:00", "2024-01-01T00:30:00-05:00"}},
+		{"15 * * * * *", "2024-01-01T00:07:00-05:00", []string{"2024-01-01T00:07:15-05:00", "2024-01-01T00:08:15-05:00"}},
+		{"30 2 * * mon-fri", "2024-01-05T03:00:00-05:00", []string{"2024-01-08T02:30:00-05:00", "2024-01-09T02:30:00-05:00"}},
+		{"0 0 1,15 * 3", "2024-01-01T00:00:00-05:00", []string{"2024-01-03T00:00:00-05:00", "2024-01-10T00:00:00-05:00", "2024-01-15T00:00:00-05:00"}},
+		// a stepped star still means both days have to match
+		{"0 0 */2 * mon", "2024-01-01T00:00:00-05:00", []string{"2024-01-15T00:00:00-05:00", "2024-01-29T00:00:00-05:00", "2024-02-05T00:00:00-05:00"}},
+		{"@monthly", "2024-01-15T00:00:00-05:00", []string{"2024-02-01T00:00:00-05:00", "2024-03-01T00:00:00-05:00"}},
+		{"CRON_TZ=UTC @daily", "2024-01-01T12:00:00-05:00", []string{"2024-01-02T00:00:00Z"}},
+
+		// spring forward, 02:30 doesn't exist
+		{"30 2 * * *", "2024-03-09T03:00:00-05:00", []string{"2024-03-10T03:30:00-04:00", "2024-03-11T02:30:00-04:00"}},
+		// fall back, 01:30 happens twice but only runs once
+		{"30 1 * * *", "2024-11-03T00:00:00-04:00", []string{"2024-11-03T01:30:00-04:00", "2024-11-04T01:30:00-05:00"}},
+		// unless it's hourly
+		{"0 * * * *", "2024-11-03T00:30:00-04:00", []string{"2024-11-03T01:00:00-04:00", "2024-11-03T01:00:00-05:00", "2024-11-03T02:00:00-05:00"}},
+		{"@hourly", "2024-03-10T00:30:00-05:00", []string{"2024-03-10T01:00:00-05:00", "2024-03-10T03:00:00-04:00", "2024-03-10T04:00:00-04:00"}},
+		{"* * * * * *", "2024-03-10T01:59:58-05:00", []string{"2024-03-10T01:59:59-05:00", "2024-03-10T03:00:00-04:00", "2024-03-10T03:00:01-04:00"}},
+		{"* * * * * *", "2024-11-03T01:59:59-04:00", []string{"2024-11-03T01:00:00-05:00", "2024-11-03T01:00:01-05:00"}},
+	}
+
+	for _, tt := range tests {
+		cs, err := ParseCronIn(tt.spec, ny)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.spec, err)
+		}
+
+		now, _ := time.Parse(time.RFC3339, tt.from)
+		for _, exp := range tt.exp {
+			now = cs.Next(now)
+			if got := now.Format(time.RFC3339); got != exp {
+				t.Errorf("%s: expected %s, got %s", tt.spec, exp, got)
+				break
+			}
+		}
+	}
+}
+
+func TestCronParseErrors(t *testing.T) {
+	for _, spec := range []string{
+		"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "@often", "TZ=Nowhere/Land * * * * *",
+	} {
+		if _, err := ParseCron(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
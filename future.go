@@ -0,0 +1,146 @@
+package otk
+
+import (
+	"context"
+	"runtime/debug"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// Future is the result of a job submitted with Submit.
+type Future[T any] struct {
+	w       *Workers
+	started chan struct{}
+	done    chan struct{}
+	v       T
+	err     error
+}
+
+// Done is closed once the job returns.
+func (f *Future[T]) Done() <-chan struct{} { return f.done }
+
+// Wait blocks until the job returns, ctx is done or the pool is closed before the job ran,
+// if the job panicked, the error is a *PanicError.
+func (f *Future[T]) Wait(ctx context.Context) (v T, err error) {
+	select {
+	case <-f.done:
+		return f.v, f.err
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-f.w.ctx.Done():
+		select {
+		case <-f.started:
+			// still running, it returns once it sees the pool's context is done
+			select {
+			case <-f.done:
+				return f.v, f.err
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+		default:
+			err = ErrClosedPool
+		}
+	}
+
+	// prefer the result if it's ready
+	select {
+	case <-f.done:
+		return f.v, f.err
+	default:
+		return v, err
+	}
+}
+
+// Submit queues fn on w and returns a Future for its result,
+// the error is the same as Workers.ExecCtx's.
+func Submit[T any](ctx context.Context, w *Workers, fn func(ctx context.Context) (T, error)) (*Future[T], error) {
+	f := &Future[T]{w: w, started: make(chan struct{}), done: make(chan struct{})}
+	if err := w.ExecCtx(ctx, func(ctx context.Context) {
+		close(f.started)
+		defer func() {
+			if p := recover(); p != nil {
+				pe := &PanicError{Value: p, Stack: debug.Stack()}
+				f.err = pe
+				close(f.done)
+				// let the pool handle it too
+				panic(pe)
+			}
+			close(f.done)
+		}()
+		f.v, f.err = fn(ctx)
+	}); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// ParallelMap calls fn for every element of in using w, and returns the results in the same order.
+// It stops at the first error, cancelling the context passed to the pending calls.
+// If the pool is full, it waits for earlier calls to finish before submitting more.
+func ParallelMap[T, R any](ctx context.Context, w *Workers, in []T, fn func(ctx context.Context, v T) (R, error)) (_ []R, err error) {
+	ctx, cfn := context.WithCancel(ctx)
+	defer cfn()
+
+	var (
+		futs = make([]*Future[R], len(in))
+		out  = make([]R, len(in))
+		next int
+
+		// the first error cancels ctx right away, so we don't wait on earlier calls to see it
+		errOnce  sync.Once
+		firstErr error
+	)
+
+	fail := func(err error) error {
+		errOnce.Do(func() {
+			firstErr = err
+			cfn()
+		})
+		return firstErr
+	}
+
+	collect := func() error {
+		v, err := futs[next].Wait(ctx)
+		if err != nil {
+			return fail(xerrors.Errorf("#%d: %w", next, err))
+		}
+		out[next] = v
+		next++
+		return nil
+	}
+
+	for i := range in {
+		i, v := i, in[i]
+		for {
+			if futs[i], err = Submit(ctx, w, func(context.Context) (R, error) {
+				if err := ctx.Err(); err != nil {
+					return *new(R), err
+				}
+				r, err := fn(ctx, v)
+				if err != nil {
+					fail(xerrors.Errorf("#%d: %w", i, err))
+				}
+				return r, err
+			}); err == nil {
+				break
+			}
+
+			if err != ErrPoolIsFull || next == i {
+				return nil, err
+			}
+
+			if err = collect(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for next < len(in) {
+		if err = collect(); err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
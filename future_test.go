@@ -0,0 +1,120 @@
+package otk
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFuture(t *testing.T) {
+	w := NewWorkers(context.Background(), 2, 1)
+	defer w.Close()
+
+	f, err := Submit(context.Background(), w, func(ctx context.Context) (int, error) {
+		time.Sleep(time.Millisecond)
+		return 42, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := f.Wait(context.Background()); v != 42 || err != nil {
+		t.Fatalf("unexpected result: %v %v", v, err)
+	}
+
+	errFail := errors.New("fail")
+	f, _ = Submit(context.Background(), w, func(ctx context.Context) (int, error) { return 0, errFail })
+	<-f.Done()
+	if _, err := f.Wait(context.Background()); err != errFail {
+		t.Fatalf("expected errFail, got %v", err)
+	}
+
+	block := make(chan struct{})
+	defer close(block)
+	f, _ = Submit(context.Background(), w, func(ctx context.Context) (int, error) { <-block; return 0, nil })
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if _, err := f.Wait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+}
+
+func TestFutureClosed(t *testing.T) {
+	w := NewWorkersWithOptions(context.Background(), &WorkersOptions{MinWorkers: 1, MaxWorkers: 1, QueueSize: 1, Mode: SubmitBlock})
+
+	started := make(chan struct{})
+	running, _ := Submit(context.Background(), w, func(ctx context.Context) (int, error) {
+		close(started)
+		<-ctx.Done()
+		return 42, ctx.Err()
+	})
+	<-started
+	queued, _ := Submit(context.Background(), w, func(ctx context.Context) (int, error) { return 0, nil })
+
+	// Submit waits for room with the caller's context
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if _, err := Submit(ctx, w, func(ctx context.Context) (int, error) { return 0, nil }); err != context.DeadlineExceeded {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+
+	w.Close()
+	if v, err := running.Wait(context.Background()); v != 42 || err != context.Canceled {
+		t.Fatalf("expected the running job's result, got %v %v", v, err)
+	}
+	if _, err := queued.Wait(context.Background()); err != ErrClosedPool {
+		t.Fatalf("expected ErrClosedPool, got %v", err)
+	}
+}
+
+func TestParallelMap(t *testing.T) {
+	w := NewWorkers(context.Background(), 2, 1)
+	defer w.Close()
+
+	in := make([]int, 100)
+	for i := range in {
+		in[i] = i
+	}
+
+	out, err := ParallelMap(context.Background(), w, in, func(ctx context.Context, v int) (string, error) {
+		return strconv.Itoa(v), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range out {
+		if s != strconv.Itoa(i) {
+			t.Fatalf("unexpected result at %d: %q", i, s)
+		}
+	}
+
+	errFail := errors.New("fail")
+	out, err = ParallelMap(context.Background(), w, in, func(ctx context.Context, v int) (string, error) {
+		if v == 10 {
+			return "", errFail
+		}
+		return "", nil
+	})
+	if !errors.Is(err, errFail) || out != nil {
+		t.Fatalf("expected errFail, got %v", err)
+	}
+
+	// a failure cancels the calls before it instead of waiting for them
+	out, err = ParallelMap(context.Background(), w, in[:2], func(ctx context.Context, v int) (string, error) {
+		if v == 1 {
+			return "", errFail
+		}
+		<-ctx.Done()
+		return "", ctx.Err()
+	})
+	if !errors.Is(err, errFail) || out != nil {
+		t.Fatalf("expected errFail, got %v", err)
+	}
+
+	out, _ = ParallelMap(context.Background(), w, []int{}, func(ctx context.Context, v int) (string, error) { return "", nil })
+	if !reflect.DeepEqual(out, []string{}) {
+		t.Fatalf("unexpected result: %#v", out)
+	}
+}
@@ -1,6 +1,6 @@
 module go.oneofone.dev/otk
 
-go 1.18
+go 1.20
 
 require (
 	go.oneofone.dev/genh v0.0.0-20230303190221-cc03787253db
@@ -11,5 +11,4 @@ require (
 require (
 	github.com/vmihailenco/msgpack/v5 v5.3.5 // indirect
 	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
-	go.oneofone.dev/oerrs v1.0.6
 )
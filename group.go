@@ -0,0 +1,82 @@
+package otk
+
+import (
+	"context"
+	"sync"
+)
+
+// NewGroup returns a Group that runs at most limit functions at once, 0 means no limit,
+// and the context passed to them, which is cancelled on the first failure or when Wait returns.
+// If allErrors is true, Wait returns an ErrorList of every failure instead of just the first one.
+func NewGroup(pctx context.Context, limit int, allErrors bool) (*Group, context.Context) {
+	ctx, cfn := context.WithCancel(pctx)
+	g := &Group{parent: pctx, ctx: ctx, cfn: cfn, all: allErrors}
+	if limit > 0 {
+		g.sem = NewSem(limit)
+	}
+	return g, ctx
+}
+
+// Group runs functions with bounded concurrency and collects their errors, see NewGroup.
+type Group struct {
+	sem    *Sem
+	wg     sync.WaitGroup
+	parent context.Context
+	ctx    context.Context
+	cfn    context.CancelFunc
+	all    bool
+
+	errOnce  sync.Once
+	err      error
+	errs     SafeErrorList
+	skipOnce sync.Once
+}
+
+// Go blocks until there's room in the group then runs fn in a goroutine,
+// fn is skipped if the group's context is done by then, if that's because the parent context is done,
+// its error is recorded once.
+func (g *Group) Go(fn func(ctx context.Context) error) {
+	err := g.ctx.Err()
+	if err == nil && g.sem != nil {
+		err = g.sem.AcquireCtx(g.ctx, 1)
+	}
+	if err != nil {
+		// the group cancels itself on the first failure, that one is already recorded
+		if perr := g.parent.Err(); perr != nil {
+			g.skipOnce.Do(func() { g.setErr(perr) })
+		}
+		return
+	}
+
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if g.sem != nil {
+			defer g.sem.Release()
+		}
+
+		if err := fn(g.ctx); err != nil {
+			g.setErr(err)
+		}
+	}()
+}
+
+func (g *Group) setErr(err error) {
+	g.errOnce.Do(func() {
+		g.err = err
+		g.cfn()
+	})
+	if g.all {
+		g.errs.Push(err)
+	}
+}
+
+// Wait waits for all the functions to return, then returns the first error, or all of them if the group was created with allErrors.
+func (g *Group) Wait() error {
+	g.wg.Wait()
+	g.cfn()
+	if g.all {
+		return g.errs.Err()
+	}
+	return g.err
+}
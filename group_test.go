@@ -0,0 +1,79 @@
+package otk
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGroup(t *testing.T) {
+	g, ctx := NewGroup(context.Background(), 2, false)
+	var running, peak atomic.Int64
+	for i := 0; i < 10; i++ {
+		g.Go(func(ctx context.Context) error {
+			n := running.Add(1)
+			defer running.Add(-1)
+			for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+			}
+			time.Sleep(time.Millisecond)
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if p := peak.Load(); p != 2 {
+		t.Fatalf("expected at most 2 concurrent functions, got %d", p)
+	}
+	if ctx.Err() == nil {
+		t.Fatal("expected the context to be cancelled after Wait")
+	}
+
+	errFail := errors.New("fail")
+	g, _ = NewGroup(context.Background(), 0, false)
+	g.Go(func(ctx context.Context) error { return errFail })
+	g.Go(func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err := g.Wait(); err != errFail {
+		t.Fatalf("expected errFail, got %v", err)
+	}
+
+	g, _ = NewGroup(context.Background(), 0, true)
+	g.Go(func(ctx context.Context) error { return errFail })
+	g.Go(func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	var el ErrorList
+	if err := g.Wait(); !errors.As(err, &el) || el.Len() != 2 {
+		t.Fatalf("expected 2 errors, got %v", err)
+	}
+
+	// functions skipped because the parent context is done still report its error, once
+	for _, limit := range []int{0, 1} {
+		pctx, cancel := context.WithCancel(context.Background())
+		g, _ = NewGroup(pctx, limit, true)
+		cancel()
+		g.Go(func(ctx context.Context) error { return nil })
+		g.Go(func(ctx context.Context) error { return nil })
+		if err := g.Wait(); !errors.As(err, &el) || el.Len() != 1 || el[0] != context.Canceled {
+			t.Fatalf("limit %d: expected context.Canceled, got %v", limit, err)
+		}
+	}
+
+	// but not when they're skipped because the group cancelled itself
+	g, _ = NewGroup(context.Background(), 0, true)
+	g.Go(func(ctx context.Context) error { return errFail })
+	for g.ctx.Err() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	g.Go(func(ctx context.Context) error { return nil })
+	g.Go(func(ctx context.Context) error { return nil })
+	if err := g.Wait(); !errors.As(err, &el) || el.Len() != 1 || el[0] != errFail {
+		t.Fatalf("expected only errFail, got %v", err)
+	}
+}
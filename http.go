@@ -16,6 +16,16 @@ import (
 type HTTPClient struct {
 	DefaultHeaders http.Header
 	DefaultQuery   url.Values
+
+	// Limiter, if set, throttles all the requests made by the client.
+	Limiter *RateLimiter
+	// HostLimiter, if set, throttles requests per host.
+	HostLimiter *KeyedRateLimiter
+
+	// Breaker, if set, fails requests fast with a *BreakerOpenError while it's open,
+	// transport errors and 5xx responses count as failures.
+	Breaker *Breaker
+
 	http.Client
 }
 
@@ -154,7 +164,40 @@ func (c *HTTPClient) Do(req *http.Request) (*http.Response, error) {
 		req.URL.RawQuery = q.Encode()
 	}
 
-	return c.Client.Do(req)
+	// check the breaker first so we don't wait on the limiters just to fail fast
+	done := func(error) {}
+	if c.Breaker != nil {
+		var err error
+		if done, err = c.Breaker.Allow(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.wait(req); err != nil {
+		done(errBreakerIgnore)
+		return nil, err
+	}
+
+	resp, err := c.Client.Do(req)
+	if err == nil && resp.StatusCode >= http.StatusInternalServerError {
+		done(xerrors.Errorf("%s: %s", req.URL, resp.Status))
+	} else {
+		done(err)
+	}
+	return resp, err
+}
+
+func (c *HTTPClient) wait(req *http.Request) error {
+	if c.Limiter != nil {
+		if err := c.Limiter.Wait(req.Context()); err != nil {
+			return err
+		}
+	}
+
+	if c.HostLimiter != nil {
+		return c.HostLimiter.Wait(req.Context(), req.URL.Host)
+	}
+	return nil
 }
 
 // Request is a wrapper for `RequestCtx(context.Background(), method, ct, url, reqData, respData)`
@@ -0,0 +1,244 @@
+package otk
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// NewRateLimiter returns a token bucket limiter that allows rate events per second with bursts of up to burst events,
+// it starts full. A rate <= 0 means no limit, it uses the Clock set on ctx by WithClock.
+func NewRateLimiter(ctx context.Context, rate float64, burst int) *RateLimiter {
+	return newRateLimiter(ClockFromContext(ctx), rate, burst)
+}
+
+func newRateLimiter(clk Clock, rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &RateLimiter{
+		clk:    clk,
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   clk.Now(),
+	}
+}
+
+type RateLimiter struct {
+	mux    sync.Mutex
+	clk    Clock
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (l *RateLimiter) Allow() bool { return l.AllowN(1) }
+
+// AllowN reports whether n events can happen now, and consumes them if so.
+func (l *RateLimiter) AllowN(n int) bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.rate <= 0 {
+		return true
+	}
+
+	l.advanceLocked(l.clk.Now())
+	if l.tokens < float64(n) {
+		return false
+	}
+	l.tokens -= float64(n)
+	return true
+}
+
+func (l *RateLimiter) Wait(ctx context.Context) error { return l.WaitN(ctx, 1) }
+
+// WaitN blocks until n events are allowed or ctx is done, it fails right away if
+// n is larger than the burst or ctx's deadline would pass before then.
+func (l *RateLimiter) WaitN(ctx context.Context, n int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r := l.ReserveN(n)
+	if !r.OK() {
+		return xerrors.Errorf("rate limiter: %d exceeds the burst of %d", n, int(l.burst))
+	}
+
+	d := r.Delay()
+	if d < 1 {
+		return nil
+	}
+
+	if dl, ok := ctx.Deadline(); ok && dl.Before(l.clk.Now().Add(d)) {
+		r.Cancel()
+		return xerrors.Errorf("rate limiter: waiting %v would exceed the context deadline", d)
+	}
+
+	if err := sleepCtx(ctx, l.clk, d); err != nil {
+		r.Cancel()
+		return err
+	}
+	return nil
+}
+
+func (l *RateLimiter) Reserve() *Reservation { return l.ReserveN(1) }
+
+// ReserveN reserves n events and returns a Reservation that says how long to wait before they can happen,
+// the reservation isn't OK if n is larger than the burst.
+func (l *RateLimiter) ReserveN(n int) *Reservation {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	now := l.clk.Now()
+	r := &Reservation{l: l, n: n, at: now}
+	if l.rate <= 0 {
+		r.ok = true
+		return r
+	}
+
+	if float64(n) > l.burst {
+		return r
+	}
+
+	l.advanceLocked(now)
+	if l.tokens -= float64(n); l.tokens < 0 {
+		r.at = now.Add(time.Duration(-l.tokens / l.rate * float64(time.Second)))
+	}
+	r.ok = true
+	return r
+}
+
+// Tokens returns the number of events that are allowed right now, negative if there are pending reservations.
+func (l *RateLimiter) Tokens() float64 {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.rate <= 0 {
+		return math.Inf(1)
+	}
+	l.advanceLocked(l.clk.Now())
+	return l.tokens
+}
+
+func (l *RateLimiter) advanceLocked(now time.Time) {
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens = math.Min(l.burst, l.tokens+elapsed.Seconds()*l.rate)
+		l.last = now
+	}
+}
+
+// Reservation is returned by RateLimiter.ReserveN.
+type Reservation struct {
+	l        *RateLimiter
+	n        int
+	at       time.Time
+	ok       bool
+	canceled bool
+}
+
+func (r *Reservation) OK() bool { return r.ok }
+
+// Delay returns how long to wait before the reserved events can happen.
+func (r *Reservation) Delay() time.Duration {
+	if !r.ok {
+		return math.MaxInt64
+	}
+	return r.at.Sub(r.l.clk.Now())
+}
+
+// Cancel returns the reserved tokens to the limiter if the reservation wasn't due yet.
+func (r *Reservation) Cancel() {
+	l := r.l
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if !r.ok || r.canceled || l.rate <= 0 {
+		return
+	}
+	r.canceled = true
+
+	now := l.clk.Now()
+	if !r.at.After(now) {
+		return
+	}
+	l.advanceLocked(now)
+	l.tokens = math.Min(l.burst, l.tokens+float64(r.n))
+}
+
+// NewKeyedRateLimiter returns a set of rate limiters, one per key (tenant, host, etc.),
+// keys that were idle for idleTTL and are back to a full bucket get evicted.
+// It uses the Clock set on ctx by WithClock.
+func NewKeyedRateLimiter(ctx context.Context, rate float64, burst int, idleTTL time.Duration) *KeyedRateLimiter {
+	if idleTTL < 1 {
+		idleTTL = 10 * time.Minute
+	}
+
+	clk := ClockFromContext(ctx)
+
+	return &KeyedRateLimiter{
+		m:     map[string]*keyedLimiter{},
+		clk:   clk,
+		rate:  rate,
+		burst: burst,
+		ttl:   idleTTL,
+		swept: clk.Now(),
+	}
+}
+
+type KeyedRateLimiter struct {
+	mux   sync.Mutex
+	m     map[string]*keyedLimiter
+	clk   Clock
+	rate  float64
+	burst int
+	ttl   time.Duration
+	swept time.Time
+}
+
+type keyedLimiter struct {
+	*RateLimiter
+	used time.Time
+}
+
+// Get returns the limiter for key, creating it if needed.
+func (k *KeyedRateLimiter) Get(key string) *RateLimiter {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+
+	now := k.clk.Now()
+	if now.Sub(k.swept) >= k.ttl {
+		k.sweepLocked(now)
+	}
+
+	kl := k.m[key]
+	if kl == nil {
+		kl = &keyedLimiter{RateLimiter: newRateLimiter(k.clk, k.rate, k.burst)}
+		k.m[key] = kl
+	}
+	kl.used = now
+	return kl.RateLimiter
+}
+
+func (k *KeyedRateLimiter) Allow(key string) bool { return k.Get(key).Allow() }
+
+func (k *KeyedRateLimiter) Wait(ctx context.Context, key string) error { return k.Get(key).Wait(ctx) }
+
+// Len returns the number of tracked keys.
+func (k *KeyedRateLimiter) Len() int {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	return len(k.m)
+}
+
+func (k *KeyedRateLimiter) sweepLocked(now time.Time) {
+	for key, kl := range k.m {
+		if now.Sub(kl.used) >= k.ttl && kl.Tokens() >= kl.burst {
+			delete(k.m, key)
+		}
+	}
+	k.swept = now
+}
@@ -0,0 +1,123 @@
+package otk
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	clk := NewManualClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	l := NewRateLimiter(WithClock(context.Background(), clk), 10, 5)
+
+	for i := 0; i < 5; i++ {
+		if !l.Allow() {
+			t.Fatalf("expected the burst to be allowed, failed at %d", i)
+		}
+	}
+	if l.Allow() {
+		t.Fatal("expected the limiter to be empty")
+	}
+
+	clk.Advance(100 * time.Millisecond)
+	if !l.Allow() || l.Allow() {
+		t.Fatal("expected exactly one token after 100ms")
+	}
+
+	r := l.ReserveN(3)
+	if !r.OK() || r.Delay() != 300*time.Millisecond {
+		t.Fatalf("unexpected reservation delay: %v", r.Delay())
+	}
+	r.Cancel()
+	if tokens := l.Tokens(); tokens != 0 {
+		t.Fatalf("expected the tokens to be returned, got %v", tokens)
+	}
+
+	if r := l.ReserveN(6); r.OK() {
+		t.Fatal("expected reserving more than the burst to fail")
+	}
+
+	done := make(chan error)
+	go func() { done <- l.WaitN(context.Background(), 2) }()
+	clk.BlockUntil(1)
+	clk.Advance(200 * time.Millisecond)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	clk.Advance(time.Second)
+	if err := l.WaitN(context.Background(), 5); err != nil {
+		t.Fatal(err)
+	}
+
+	l = NewRateLimiter(context.Background(), 1, 1)
+	l.Allow()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx); err == nil || ctx.Err() != nil {
+		t.Fatalf("expected waiting past the deadline to fail right away, got %v", err)
+	}
+}
+
+func TestKeyedRateLimiter(t *testing.T) {
+	clk := NewManualClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	k := NewKeyedRateLimiter(WithClock(context.Background(), clk), 1, 1, time.Minute)
+
+	if !k.Allow("a") || !k.Allow("b") || k.Allow("a") {
+		t.Fatal("expected keys to be limited independently")
+	}
+
+	clk.Advance(30 * time.Second)
+	k.Allow("a")
+	clk.Advance(40 * time.Second)
+	k.Get("c")
+	if n := k.Len(); n != 2 {
+		t.Fatalf("expected the idle key to be evicted, got %d keys", n)
+	}
+}
+
+func TestWorkersRateLimiter(t *testing.T) {
+	w := NewWorkers(context.Background(), 4, 1)
+	defer w.Close()
+	w.SetRateLimiter(NewRateLimiter(context.Background(), 100, 1))
+
+	var n atomic.Int64
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		w.Exec(func(context.Context) { n.Add(1) })
+	}
+	for n.Load() < 5 {
+		time.Sleep(time.Millisecond)
+	}
+	if took := time.Since(start); took < 40*time.Millisecond {
+		t.Fatalf("expected 5 jobs to take at least 40ms, took %v", took)
+	}
+}
+
+func TestWorkersRateLimiterDeadline(t *testing.T) {
+	// the limiter would wait past the pool's deadline, the workers should wait anyway instead of dropping the jobs
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	w := NewWorkersWithOptions(ctx, &WorkersOptions{MinWorkers: 1, MaxWorkers: 1, QueueSize: 3})
+	defer w.Close()
+	clk := NewManualClock(time.Now())
+	w.SetRateLimiter(NewRateLimiter(WithClock(context.Background(), clk), 0.01, 1))
+
+	var n atomic.Int64
+	for i := 0; i < 3; i++ {
+		if err := w.Exec(func(context.Context) { n.Add(1) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(1); i < 3; i++ {
+		clk.BlockUntil(1)
+		if n.Load() != i || w.Workers() != 1 {
+			t.Fatalf("expected %d jobs to run and 1 worker, got %d and %d", i, n.Load(), w.Workers())
+		}
+		clk.Advance(100 * time.Second)
+	}
+	for n.Load() != 3 {
+		time.Sleep(time.Millisecond)
+	}
+}
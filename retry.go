@@ -2,6 +2,9 @@ package otk
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math"
 	"time"
 )
 
@@ -11,11 +14,27 @@ func Retry(fn func() error, attempts uint, delay time.Duration, backoffMod float
 }
 
 // RetryCtx calls fn every (delay * backoffMod) until it returns nil, the passed ctx is done or attempts are reached.
+// It sleeps using the Clock set on ctx by WithClock.
+// fn is called in a goroutine so RetryCtx can return as soon as ctx is done, the goroutine exits
+// once fn returns, use RetryFnCtx if fn can take a context.
 func RetryCtx(ctx context.Context, fn func() error, attempts uint, delay time.Duration, backoffMod float64) error {
-	if delay == 0 {
-		delay = time.Second
+	ret := make(chan error, 1)
+
+	go func() {
+		ret <- RetryFnCtx(ctx, func(context.Context, uint) error { return fn() }, attempts, delay, backoffMod)
+	}()
+
+	select {
+	case err := <-ret:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
 
+// RetryFnCtx is like RetryCtx, but fn gets the context and the attempt number (starting at 1),
+// and it's called on the current goroutine so nothing keeps running once it returns.
+func RetryFnCtx(ctx context.Context, fn func(ctx context.Context, attempt uint) error, attempts uint, delay time.Duration, backoffMod float64) error {
 	if attempts == 0 {
 		attempts = 1
 	}
@@ -24,24 +43,226 @@ func RetryCtx(ctx context.Context, fn func() error, attempts uint, delay time.Du
 		backoffMod = 1
 	}
 
-	ret := make(chan error, 1)
+	p := RetryPolicy{Attempts: attempts, Delay: delay, Multiplier: backoffMod}
+	return p.DoCtx(ctx, fn)
+}
 
-	go func() {
-		var err error
-		for ; attempts > 0; attempts-- {
-			if err = fn(); err == nil {
-				break
+// RetryValue calls fn using p until it succeeds and returns its value.
+// On failure it returns a *RetryError with the errors of every attempt, a nil p is the zero RetryPolicy.
+func RetryValue[T any](ctx context.Context, p *RetryPolicy, fn func(ctx context.Context, attempt uint) (T, error)) (v T, err error) {
+	if p == nil {
+		p = &RetryPolicy{}
+	}
+
+	var (
+		clk  = ClockFromContext(ctx)
+		rerr RetryError
+	)
+
+	if err = p.DoCtx(ctx, func(ctx context.Context, attempt uint) (err error) {
+		start := clk.Now()
+		if v, err = fn(ctx, attempt); err != nil {
+			ra := RetryAttempt{Attempt: attempt, Start: start, Took: clk.Now().Sub(start), Err: err}
+			var pe *permanentError
+			if errors.As(err, &pe) {
+				ra.Err = pe.err
 			}
-			time.Sleep(delay)
-			delay = time.Duration(float64(delay) * backoffMod)
+			rerr.Attempts = append(rerr.Attempts, ra)
 		}
-		ret <- err
-	}()
+		return
+	}); err == nil {
+		return v, nil
+	}
 
-	select {
-	case err := <-ret:
-		return err
-	case <-ctx.Done():
-		return ctx.Err()
+	if cerr := ctx.Err(); cerr != nil && err == cerr {
+		if n := len(rerr.Attempts); n == 0 || !errors.Is(rerr.Attempts[n-1].Err, cerr) {
+			rerr.Err = cerr
+		}
+	}
+
+	var zero T
+	return zero, &rerr
+}
+
+// RetryAttempt is a failed attempt of RetryValue.
+type RetryAttempt struct {
+	Attempt uint
+	Start   time.Time
+	Took    time.Duration
+	Err     error
+}
+
+func (ra RetryAttempt) Error() string {
+	return fmt.Sprintf("attempt #%d (took %v): %v", ra.Attempt, ra.Took, ra.Err)
+}
+
+func (ra RetryAttempt) Unwrap() error { return ra.Err }
+
+// RetryError is returned by RetryValue when it gives up.
+type RetryError struct {
+	Attempts []RetryAttempt
+	// Err is set if it gave up because the context was done.
+	Err error
+}
+
+// Errors returns the error of every attempt, followed by Err if it's set.
+func (e *RetryError) Errors() ErrorList {
+	el := make(ErrorList, 0, len(e.Attempts)+1)
+	for _, ra := range e.Attempts {
+		el = append(el, ra)
+	}
+	el.Push(e.Err)
+	return el
+}
+
+func (e *RetryError) Error() string { return e.Errors().Error() }
+
+func (e *RetryError) Unwrap() []error { return e.Errors() }
+
+// RetryJitter selects how RetryPolicy randomizes its delays.
+type RetryJitter uint8
+
+const (
+	// JitterNone sleeps exactly Delay * Multiplier^(attempt-1).
+	JitterNone RetryJitter = iota
+	// JitterFull sleeps a random duration between 0 and the exponential delay.
+	JitterFull
+	// JitterEqual sleeps half the exponential delay plus a random duration up to the other half.
+	JitterEqual
+	// JitterDecorrelated sleeps a random duration between Delay and 3 times the previous sleep.
+	JitterDecorrelated
+)
+
+// RetryPolicy is a configurable alternative to RetryCtx, the zero value retries forever with
+// a delay starting at one second and doubling every attempt.
+type RetryPolicy struct {
+	// Attempts is the maximum number of calls, 0 means no limit.
+	Attempts uint
+	// Delay is the base delay, defaults to one second.
+	Delay time.Duration
+	// MaxDelay caps a single delay, 0 means no limit.
+	MaxDelay time.Duration
+	// MaxElapsed stops retrying if the next attempt would start after MaxElapsed since the first one, 0 means no limit.
+	MaxElapsed time.Duration
+	// Multiplier is applied to the delay after every attempt, defaults to 2.
+	Multiplier float64
+	Jitter     RetryJitter
+
+	// Retryable returns false for errors that shouldn't be retried, errors wrapped with Permanent are never retried.
+	Retryable func(err error) bool
+	// OnRetry is called before sleeping for delay after the attempt-th call failed with err.
+	OnRetry func(attempt uint, err error, delay time.Duration)
+}
+
+// Do is an alias for DoCtx for functions that don't need the context or attempt number.
+func (p *RetryPolicy) Do(ctx context.Context, fn func() error) error {
+	return p.DoCtx(ctx, func(context.Context, uint) error { return fn() })
+}
+
+// DoCtx calls fn with ctx and the attempt number (starting at 1) until it returns nil, a permanent error,
+// or the policy's limits are reached, in which case it returns the last error.
+// It returns ctx.Err() if ctx is done before an attempt or while sleeping, using the Clock set on ctx by WithClock.
+func (p *RetryPolicy) DoCtx(ctx context.Context, fn func(ctx context.Context, attempt uint) error) error {
+	var (
+		clk   = ClockFromContext(ctx)
+		start = clk.Now()
+		delay time.Duration
+	)
+
+	for attempt := uint(1); ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		err := fn(ctx, attempt)
+		if err == nil {
+			return nil
+		}
+
+		var pe *permanentError
+		if errors.As(err, &pe) {
+			return pe.err
+		}
+
+		if (p.Retryable != nil && !p.Retryable(err)) || (p.Attempts > 0 && attempt >= p.Attempts) {
+			return err
+		}
+
+		delay = p.backoff(attempt, delay)
+		if p.MaxElapsed > 0 && clk.Now().Add(delay).Sub(start) > p.MaxElapsed {
+			return err
+		}
+
+		if p.OnRetry != nil {
+			p.OnRetry(attempt, err, delay)
+		}
+
+		if err := sleepCtx(ctx, clk, delay); err != nil {
+			return err
+		}
 	}
 }
+
+// backoff returns the delay after the attempt-th call, prev is the last returned delay.
+func (p *RetryPolicy) backoff(attempt uint, prev time.Duration) (d time.Duration) {
+	base := p.Delay
+	if base < 1 {
+		base = time.Second
+	}
+
+	if p.Jitter == JitterDecorrelated {
+		if prev < base {
+			prev = base
+		} else if prev > math.MaxInt64/3 {
+			prev = math.MaxInt64 / 3
+		}
+		d = base + randDuration(prev*3-base)
+	} else {
+		mult := p.Multiplier
+		if mult == 0 {
+			mult = 2
+		}
+
+		if f := float64(base) * math.Pow(mult, float64(attempt-1)); f < math.MaxInt64 {
+			d = time.Duration(f)
+		} else {
+			d = math.MaxInt64
+		}
+	}
+
+	if p.MaxDelay > 0 && (d > p.MaxDelay || d < 0) {
+		d = p.MaxDelay
+	}
+
+	switch p.Jitter {
+	case JitterFull:
+		d = randDuration(d)
+	case JitterEqual:
+		d = d/2 + randDuration(d-d/2)
+	}
+	return
+}
+
+var retryRNG XorShiftRNG
+
+func randDuration(n time.Duration) time.Duration {
+	if n < 1 {
+		return 0
+	}
+	return time.Duration(retryRNG.Uint64() % uint64(n))
+}
+
+// Permanent wraps err so RetryPolicy stops retrying and returns err as-is.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err}
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
@@ -0,0 +1,203 @@
+package otk
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestRetryClock(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := NewManualClock(start)
+	ctx := WithClock(context.Background(), clk)
+
+	go func() {
+		for d := time.Hour; d <= 4*time.Hour; d *= 2 {
+			clk.BlockUntil(1)
+			clk.Advance(d)
+		}
+	}()
+
+	n := 0
+	err := RetryCtx(ctx, func() error {
+		if n++; n < 4 {
+			return errors.New("not yet")
+		}
+		return nil
+	}, 5, time.Hour, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 4 {
+		t.Fatalf("expected 4 attempts, got %d", n)
+	}
+
+	if took := clk.Now().Sub(start); took != 7*time.Hour {
+		t.Fatalf("expected 7h of backoff, got %v", took)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	clk := NewManualClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	ctx, cancel := context.WithCancel(WithClock(context.Background(), clk))
+	defer cancel()
+	go func() {
+		for ctx.Err() == nil {
+			if clk.Waiters() > 0 {
+				clk.Advance(time.Second)
+			}
+			time.Sleep(time.Microsecond)
+		}
+	}()
+
+	errFail, errFatal := errors.New("fail"), errors.New("fatal")
+
+	var delays []time.Duration
+	p := RetryPolicy{
+		Attempts: 5,
+		Delay:    10 * time.Millisecond,
+		MaxDelay: 50 * time.Millisecond,
+		OnRetry: func(attempt uint, err error, delay time.Duration) {
+			if attempt != uint(len(delays)+1) || err != errFail {
+				t.Errorf("unexpected OnRetry(%d, %v)", attempt, err)
+			}
+			delays = append(delays, delay)
+		},
+	}
+
+	n := 0
+	if err := p.Do(ctx, func() error { n++; return errFail }); err != errFail || n != 5 {
+		t.Fatalf("expected 5 failed attempts, got %d: %v", n, err)
+	}
+
+	exp := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 50 * time.Millisecond}
+	if !reflect.DeepEqual(delays, exp) {
+		t.Fatalf("expected %v, got %v", exp, delays)
+	}
+
+	p.OnRetry = nil
+	n = 0
+	if err := p.Do(ctx, func() error { n++; return Permanent(errFatal) }); err != errFatal || n != 1 {
+		t.Fatalf("expected 1 attempt, got %d: %v", n, err)
+	}
+
+	p.Retryable = func(err error) bool { return err != errFatal }
+	n = 0
+	if err := p.Do(ctx, func() error {
+		if n++; n == 2 {
+			return errFatal
+		}
+		return errFail
+	}); err != errFatal || n != 2 {
+		t.Fatalf("expected 2 attempts, got %d: %v", n, err)
+	}
+
+	p = RetryPolicy{Delay: time.Second, Multiplier: 1, MaxElapsed: 5 * time.Second}
+	n = 0
+	if err := p.Do(ctx, func() error { n++; return errFail }); err != errFail || n != 6 {
+		t.Fatalf("expected 6 attempts, got %d: %v", n, err)
+	}
+}
+
+func TestRetryJitter(t *testing.T) {
+	for _, j := range []RetryJitter{JitterFull, JitterEqual, JitterDecorrelated} {
+		p := RetryPolicy{Delay: time.Second, MaxDelay: time.Minute, Jitter: j}
+		var d time.Duration
+		for attempt := uint(1); attempt < 100; attempt++ {
+			d = p.backoff(attempt, d)
+			if d < 0 || d > time.Minute {
+				t.Fatalf("jitter %d: delay out of range: %v", j, d)
+			}
+			if j == JitterDecorrelated && d < time.Second {
+				t.Fatalf("jitter %d: delay is less than the base delay: %v", j, d)
+			}
+		}
+	}
+}
+
+func TestRetryCancel(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var attempts []uint
+	err := RetryFnCtx(ctx, func(ctx context.Context, attempt uint) error {
+		if attempts = append(attempts, attempt); attempt == 2 {
+			cancel()
+		}
+		return errors.New("fail")
+	}, 10, time.Millisecond, 1)
+	if err != context.Canceled || !reflect.DeepEqual(attempts, []uint{1, 2}) {
+		t.Fatalf("unexpected result: %v %v", err, attempts)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	calls := make(chan struct{}, 10)
+	go func() {
+		<-calls
+		cancel()
+	}()
+	if err := RetryCtx(ctx, func() error {
+		calls <- struct{}{}
+		return errors.New("fail")
+	}, 10, time.Hour, 1); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if n := len(calls); n != 0 {
+		t.Fatalf("expected no more calls after cancel, got %d", n)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Fatalf("leaked %d goroutines", after-before)
+	}
+}
+
+func TestRetryValue(t *testing.T) {
+	ctx := context.Background()
+	p := &RetryPolicy{Attempts: 3, Delay: time.Millisecond}
+
+	v, err := RetryValue(ctx, p, func(ctx context.Context, attempt uint) (string, error) {
+		if attempt < 3 {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "ok", nil
+	})
+	if err != nil || v != "ok" {
+		t.Fatalf("unexpected result: %q %v", v, err)
+	}
+
+	errs := []error{io.EOF, io.ErrClosedPipe, io.ErrNoProgress}
+	v, err = RetryValue(ctx, p, func(ctx context.Context, attempt uint) (string, error) {
+		return "partial", errs[attempt-1]
+	})
+	if v != "" {
+		t.Fatalf("expected the zero value, got %q", v)
+	}
+
+	var rerr *RetryError
+	if !errors.As(err, &rerr) || len(rerr.Attempts) != 3 || rerr.Err != nil {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+	for i, ra := range rerr.Attempts {
+		if ra.Attempt != uint(i+1) || ra.Err != errs[i] || ra.Start.IsZero() {
+			t.Fatalf("unexpected attempt: %+v", ra)
+		}
+	}
+	if !errors.Is(err, io.ErrClosedPipe) || rerr.Errors().Len() != 3 {
+		t.Fatalf("expected the error to wrap every attempt: %v", err)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	_, err = RetryValue(cctx, p, func(ctx context.Context, attempt uint) (int, error) {
+		cancel()
+		return 0, io.EOF
+	})
+	if !errors.As(err, &rerr) || len(rerr.Attempts) != 1 || rerr.Err != context.Canceled || !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+}
@@ -3,6 +3,7 @@ package otk
 import (
 	"context"
 	"errors"
+	"sort"
 	"sync"
 	"time"
 
@@ -14,49 +15,189 @@ type TaskFunc = func(ctx context.Context, t time.Time) error
 // ErrStopTask can be returned to stop the run loop
 var ErrStopTask = errors.New("STOP")
 
+// Schedule decides when a task runs next.
+type Schedule interface {
+	// Next returns the next activation time after t, or the zero time to stop the task.
+	Next(t time.Time) time.Time
+}
+
+// SchedulerOptions are optional settings for NewSchedulerWithOptions.
+type SchedulerOptions struct {
+	// OnRun is called after every task run with a snapshot of the task's state.
+	OnRun func(ti TaskInfo)
+
+	// Store persists the last run of every task, which is used to catch up on
+	// missed runs after a restart, see MisfirePolicy.
+	Store SchedulerStore
+}
+
+// OverlapPolicy decides what happens when a task is due while it's still running.
+type OverlapPolicy uint8
+
+const (
+	// OverlapSkip drops activations while the task is running, this is the default.
+	OverlapSkip OverlapPolicy = iota
+	// OverlapQueue runs the task once more right after the current run ends, no matter how many activations were missed.
+	OverlapQueue
+	// OverlapAllow runs the task concurrently.
+	OverlapAllow
+)
+
+// MisfirePolicy decides what happens to the activations a task missed while the scheduler wasn't running,
+// it requires SchedulerOptions.Store to be set. Schedules from Every count the missed activations from the stored last run,
+// since they're anchored to when the task was started. Paused tasks don't catch up.
+type MisfirePolicy uint8
+
+const (
+	// MisfireSkip ignores missed activations, this is the default.
+	MisfireSkip MisfirePolicy = iota
+	// MisfireRunOnce runs the task once on start if it missed any activations.
+	MisfireRunOnce
+	// MisfireRunAll runs the task on start for every missed activation, in order.
+	MisfireRunAll
+)
+
+// TaskOptions are optional per task settings for StartWithOptions.
+type TaskOptions struct {
+	Overlap OverlapPolicy
+	Misfire MisfirePolicy
+	// MaxMisfires caps how many missed activations MisfireRunAll runs, the most recent ones are kept, defaults to 100.
+	MaxMisfires int
+	// Paused starts the task paused, see Scheduler.Resume.
+	Paused bool
+}
+
+// TaskInfo is a snapshot of a scheduled task's state.
+type TaskInfo struct {
+	ID   string
+	Next time.Time
+
+	LastRun      time.Time
+	LastDuration time.Duration
+	LastErr      error
+
+	Paused  bool
+	Running int
+
+	Runs uint64
+	// Failures is the number of consecutive runs that returned an error.
+	Failures uint64
+}
+
 func NewScheduler(pctx context.Context) *Scheduler {
+	return NewSchedulerWithOptions(pctx, nil)
+}
+
+func NewSchedulerWithOptions(pctx context.Context, opts *SchedulerOptions) *Scheduler {
 	ctx, cfn := context.WithCancel(pctx)
 
+	if opts == nil {
+		opts = &SchedulerOptions{}
+	}
+
 	return &Scheduler{
 		tasks: make(map[string]*task),
+		opts:  *opts,
+		clk:   ClockFromContext(ctx),
 
 		ctx: ctx,
 		cfn: cfn,
 	}
 }
 
+// Scheduler runs tasks on a Schedule, it uses the Clock set on its context by WithClock.
 type Scheduler struct {
 	mux   sync.Mutex
 	tasks map[string]*task
+	opts  SchedulerOptions
+	clk   Clock
 
 	ctx context.Context
 	cfn context.CancelFunc
 }
 
 func (c *Scheduler) Start(id string, fn TaskFunc, startIn, thenEvery time.Duration) error {
+	return c.StartSchedule(id, fn, c.Every(startIn, thenEvery))
+}
+
+// Every returns the Schedule used by Start, so it can be used with StartWithOptions,
+// it activates in startIn (1 second if < 1) on the scheduler's clock, then every thenEvery, or never again if it's < 1.
+func (c *Scheduler) Every(startIn, thenEvery time.Duration) Schedule {
+	if startIn < 1 {
+		startIn = time.Second
+	}
+	return &everySchedule{start: c.clk.Now().Add(startIn), every: thenEvery}
+}
+
+// StartCron parses spec with ParseCron and starts the task on it.
+func (c *Scheduler) StartCron(id, spec string, fn TaskFunc) error {
+	cs, err := ParseCron(spec)
+	if err != nil {
+		return err
+	}
+	return c.StartSchedule(id, fn, cs)
+}
+
+func (c *Scheduler) StartSchedule(id string, fn TaskFunc, sch Schedule) error {
+	return c.StartWithOptions(id, fn, sch, nil)
+}
+
+func (c *Scheduler) StartWithOptions(id string, fn TaskFunc, sch Schedule, opts *TaskOptions) error {
 	c.mux.Lock()
 	defer c.mux.Unlock()
 	if c.tasks[id] != nil {
 		return xerrors.Errorf("task %q already exists", id)
 	}
 
-	if startIn < 1 {
-		startIn = time.Second
+	if opts == nil {
+		opts = &TaskOptions{}
+	}
+	maxMisfires := opts.MaxMisfires
+	if maxMisfires < 1 {
+		maxMisfires = 100
 	}
 
 	ctx, cfn := context.WithCancel(c.ctx)
 	tsk := &task{
-		ctx:   ctx,
-		cfn:   cfn,
-		tk:    time.NewTicker(startIn),
-		every: thenEvery,
+		ctx: ctx,
+		cfn: cfn,
+		sch: sch,
+		clk: c.clk,
 
-		fn: fn,
+		fn:      fn,
+		onRun:   c.opts.OnRun,
+		store:   c.opts.Store,
+		overlap: opts.Overlap,
+		info:    TaskInfo{ID: id, Paused: opts.Paused},
+	}
+
+	var missed []time.Time
+	if tsk.store != nil {
+		st, ok, err := tsk.store.Load(id)
+		if err != nil {
+			cfn()
+			return xerrors.Errorf("task %q: error loading state: %w", id, err)
+		}
+		if ok {
+			tsk.info.LastRun = st.LastRun
+			if !opts.Paused {
+				missed = misfires(sch, st.LastRun, c.clk.Now(), opts.Misfire, maxMisfires)
+			}
+		}
 	}
 
 	c.tasks[id] = tsk
 	go func() {
-		defer c.Stop(id)
+		defer c.remove(id, tsk)
+		for _, at := range missed {
+			if ctx.Err() != nil {
+				return
+			}
+			tsk.mux.Lock()
+			tsk.info.Running++
+			tsk.mux.Unlock()
+			tsk.exec(at)
+		}
 		tsk.run()
 	}()
 
@@ -75,44 +216,243 @@ func (c *Scheduler) Stop(id string) error {
 	return nil
 }
 
+// RunNow runs the task out of band, even if it's paused, honoring its OverlapPolicy.
+func (c *Scheduler) RunNow(id string) error {
+	t, err := c.get(id)
+	if err != nil {
+		return err
+	}
+	t.trigger(c.clk.Now())
+	return nil
+}
+
+// Pause stops a task from running on its schedule until Resume is called.
+func (c *Scheduler) Pause(id string) error {
+	return c.setPaused(id, true)
+}
+
+func (c *Scheduler) Resume(id string) error {
+	return c.setPaused(id, false)
+}
+
+func (c *Scheduler) setPaused(id string, v bool) error {
+	t, err := c.get(id)
+	if err != nil {
+		return err
+	}
+	t.mux.Lock()
+	t.info.Paused = v
+	t.mux.Unlock()
+	return nil
+}
+
+func (c *Scheduler) get(id string) (*task, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if t := c.tasks[id]; t != nil {
+		return t, nil
+	}
+	return nil, xerrors.Errorf("task %q does not exist", id)
+}
+
+// remove deletes the task if it wasn't replaced after being stopped.
+func (c *Scheduler) remove(id string, t *task) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	t.stop()
+	if c.tasks[id] == t {
+		delete(c.tasks, id)
+	}
+}
+
 func (c *Scheduler) StopAll() {
 	c.cfn()
 }
 
+// Task returns a snapshot of the task's state.
+func (c *Scheduler) Task(id string) (ti TaskInfo, ok bool) {
+	c.mux.Lock()
+	t := c.tasks[id]
+	c.mux.Unlock()
+	if t == nil {
+		return
+	}
+	return t.snapshot(), true
+}
+
+// Tasks returns a snapshot of all the running tasks, sorted by id.
+func (c *Scheduler) Tasks() []TaskInfo {
+	c.mux.Lock()
+	out := make([]TaskInfo, 0, len(c.tasks))
+	for _, t := range c.tasks {
+		out = append(out, t.snapshot())
+	}
+	c.mux.Unlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
 type task struct {
-	ctx   context.Context
-	cfn   context.CancelFunc
-	tk    *time.Ticker
-	fn    TaskFunc
-	every time.Duration
+	ctx     context.Context
+	cfn     context.CancelFunc
+	sch     Schedule
+	clk     Clock
+	fn      TaskFunc
+	onRun   func(ti TaskInfo)
+	store   SchedulerStore
+	overlap OverlapPolicy
+
+	mux    sync.Mutex
+	info   TaskInfo
+	queued bool
 }
 
 func (t *task) run() {
-	defer t.tk.Stop()
-	hitFirst := false
-	for {
+	for next := t.setNext(t.sch.Next(t.clk.Now())); !next.IsZero(); {
+		tm := t.clk.NewTimer(next.Sub(t.clk.Now()))
 		select {
-		case now := <-t.tk.C:
-			if !hitFirst {
-				hitFirst = true
-				t.tk.Stop()
-				t.tk = time.NewTicker(t.every)
+		case now := <-tm.C():
+			t.mux.Lock()
+			paused := t.info.Paused
+			t.mux.Unlock()
+			if !paused {
+				t.trigger(now)
 			}
 
-			if t.fn(t.ctx, now) == ErrStopTask {
-				return
+		case <-t.ctx.Done():
+			tm.Stop()
+			return
+		}
+
+		// skip any activations we missed
+		if next = t.sch.Next(next); !next.IsZero() {
+			if now := t.clk.Now(); next.Before(now) {
+				next = t.sch.Next(now)
 			}
+		}
+		t.setNext(next)
+	}
+}
 
-		case <-t.ctx.Done():
+func (t *task) trigger(now time.Time) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.info.Running > 0 {
+		switch t.overlap {
+		case OverlapSkip:
+			return
+		case OverlapQueue:
+			t.queued = true
+			return
+		}
+	}
+	t.info.Running++
+	go t.exec(now)
+}
+
+func (t *task) exec(now time.Time) {
+	for {
+		start := t.clk.Now()
+		err := t.fn(t.ctx, now)
+		took := t.clk.Now().Sub(start)
+
+		if t.store != nil {
+			if serr := t.store.Save(t.info.ID, TaskState{LastRun: now}); serr != nil && err == nil {
+				err = xerrors.Errorf("error saving state: %w", serr)
+			}
+		}
+
+		t.mux.Lock()
+		ti := &t.info
+		ti.LastRun, ti.LastDuration = start, took
+		ti.Runs++
+		ti.Running--
+		if err != nil && err != ErrStopTask {
+			ti.LastErr = err
+			ti.Failures++
+		} else {
+			ti.LastErr = nil
+			ti.Failures = 0
+		}
+		cp := *ti
+
+		again := t.queued && err != ErrStopTask && t.ctx.Err() == nil
+		if t.queued = false; again {
+			ti.Running++
+		}
+		t.mux.Unlock()
+
+		if t.onRun != nil {
+			t.onRun(cp)
+		}
+
+		if err == ErrStopTask {
+			t.stop()
+		}
+
+		if !again {
 			return
 		}
+		now = t.clk.Now()
 	}
 }
 
+func (t *task) setNext(next time.Time) time.Time {
+	t.mux.Lock()
+	t.info.Next = next
+	t.mux.Unlock()
+	return next
+}
+
+func (t *task) snapshot() TaskInfo {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.info
+}
+
 func (t *task) stop() {
 	t.cfn()
 }
 
+// misfires returns up to limit of the most recent activations of sch between lastRun and now that should run according to p.
+func misfires(sch Schedule, lastRun, now time.Time, p MisfirePolicy, limit int) (out []time.Time) {
+	if p == MisfireSkip || lastRun.IsZero() {
+		return
+	}
+
+	if p == MisfireRunOnce {
+		limit = 1
+	}
+
+	// the start of an interval schedule is when the task was started, not when it last ran
+	if es, ok := sch.(*everySchedule); ok {
+		sch = &everySchedule{start: lastRun, every: es.every}
+	}
+
+	for at := sch.Next(lastRun); !at.IsZero() && !at.After(now); at = sch.Next(at) {
+		if out = append(out, at); len(out) > limit {
+			out = out[1:]
+		}
+	}
+	return
+}
+
+type everySchedule struct {
+	start time.Time
+	every time.Duration
+}
+
+func (s *everySchedule) Next(t time.Time) time.Time {
+	if t.Before(s.start) {
+		return s.start
+	}
+	if s.every < 1 {
+		return time.Time{}
+	}
+	return s.start.Add((t.Sub(s.start)/s.every + 1) * s.every)
+}
+
 // TimeUntil is a tiny helper to return the duration until hour:min:sec
 // if the duration is in the past and nextDay is true, it'll add 24 hours.
 func TimeUntil(t time.Time, hour, min, sec int, nextDay bool) time.Duration {
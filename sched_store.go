@@ -0,0 +1,53 @@
+package otk
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// TaskState is the part of a task's state that's persisted by a SchedulerStore.
+type TaskState struct {
+	// LastRun is the activation time of the last run.
+	LastRun time.Time `json:"lastRun"`
+}
+
+// SchedulerStore persists task state across restarts, see SchedulerOptions.Store.
+type SchedulerStore interface {
+	Load(id string) (st TaskState, ok bool, err error)
+	Save(id string, st TaskState) error
+}
+
+// NewFileSchedulerStore returns a SchedulerStore that keeps the state of all the tasks in a json file,
+// each save atomically replaces the file using CopyOnWriteFile.
+func NewFileSchedulerStore(fp string) (*FileSchedulerStore, error) {
+	fs := &FileSchedulerStore{fp: fp, m: map[string]TaskState{}}
+	if err := ReadJSONFile(fp, &fs.m); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return fs, nil
+}
+
+type FileSchedulerStore struct {
+	mux sync.Mutex
+	fp  string
+	m   map[string]TaskState
+}
+
+func (fs *FileSchedulerStore) Load(id string) (st TaskState, ok bool, err error) {
+	fs.mux.Lock()
+	st, ok = fs.m[id]
+	fs.mux.Unlock()
+	return
+}
+
+func (fs *FileSchedulerStore) Save(id string, st TaskState) error {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+	fs.m[id] = st
+	return CopyOnWriteFile(fs.fp, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(fs.m)
+	})
+}
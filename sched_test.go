@@ -2,12 +2,21 @@ package otk
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 func TestScheduler(t *testing.T) {
-	sch := NewScheduler(context.Background())
+	clk := NewManualClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	runs := make(chan struct{}, 1)
+	sch := NewSchedulerWithOptions(WithClock(context.Background(), clk), &SchedulerOptions{
+		OnRun: func(TaskInfo) { runs <- struct{}{} },
+	})
 	defer sch.StopAll()
 
 	count := 0
@@ -16,10 +25,210 @@ func TestScheduler(t *testing.T) {
 		return nil
 	}, time.Millisecond, time.Millisecond)
 
-	time.Sleep(time.Second / 4)
+	for i := 0; i < 250; i++ {
+		clk.BlockUntil(1)
+		clk.Advance(time.Millisecond)
+		<-runs
+	}
+
 	sch.Stop("w00t")
-	time.Sleep(time.Second / 4)
-	if count < 230 || count > 250 {
-		t.Fatalf("expected 230-250, got %d", count)
+	clk.Advance(time.Second)
+	if count != 250 {
+		t.Fatalf("expected 250, got %d", count)
+	}
+}
+
+func TestSchedulerTasks(t *testing.T) {
+	errOdd := errors.New("odd")
+	runs := make(chan TaskInfo, 10)
+	sch := NewSchedulerWithOptions(context.Background(), &SchedulerOptions{
+		OnRun: func(ti TaskInfo) {
+			select {
+			case runs <- ti:
+			default:
+			}
+		},
+	})
+	defer sch.StopAll()
+
+	count := 0
+	sch.Start("odd", func(ctx context.Context, now time.Time) error {
+		if count++; count%2 == 1 {
+			return errOdd
+		}
+		return nil
+	}, time.Millisecond, time.Millisecond)
+	sch.Start("hourly", func(ctx context.Context, now time.Time) error { return nil }, time.Hour, time.Hour)
+
+	for i := 1; i <= 3; i++ {
+		ti := <-runs
+		if ti.ID != "odd" || ti.Runs != uint64(i) || ti.LastRun.IsZero() {
+			t.Fatalf("unexpected run info: %+v", ti)
+		}
+		if odd := i%2 == 1; odd != (ti.LastErr == errOdd) || odd != (ti.Failures == 1) {
+			t.Fatalf("unexpected run info: %+v", ti)
+		}
+	}
+
+	tasks := sch.Tasks()
+	if len(tasks) != 2 || tasks[0].ID != "hourly" || tasks[1].ID != "odd" {
+		t.Fatalf("unexpected tasks: %+v", tasks)
+	}
+	if ti := tasks[0]; ti.Runs != 0 || time.Until(ti.Next) < 59*time.Minute {
+		t.Fatalf("unexpected task info: %+v", ti)
+	}
+}
+
+func TestSchedulerOverlap(t *testing.T) {
+	clk := NewManualClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	done := make(chan TaskInfo, 10)
+	sch := NewSchedulerWithOptions(WithClock(context.Background(), clk), &SchedulerOptions{
+		OnRun: func(ti TaskInfo) { done <- ti },
+	})
+	defer sch.StopAll()
+
+	for _, tc := range []struct {
+		p   OverlapPolicy
+		exp int64
+	}{
+		{OverlapSkip, 1},
+		{OverlapQueue, 2},
+		{OverlapAllow, 3},
+	} {
+		var runs atomic.Int64
+		block, started := make(chan struct{}), make(chan struct{}, 3)
+		id := fmt.Sprintf("overlap:%d", tc.p)
+		sch.StartWithOptions(id, func(ctx context.Context, now time.Time) error {
+			runs.Add(1)
+			started <- struct{}{}
+			<-block
+			return nil
+		}, sch.Every(time.Hour, time.Hour), &TaskOptions{Overlap: tc.p})
+
+		if err := sch.RunNow(id); err != nil {
+			t.Fatal(err)
+		}
+		<-started
+
+		// RunNow decides whether to skip, queue or run right away
+		sch.RunNow(id)
+		sch.RunNow(id)
+		if tc.p == OverlapAllow {
+			<-started
+			<-started
+		}
+		close(block)
+
+		for i := int64(0); i < tc.exp; i++ {
+			<-done
+		}
+		if ti, _ := sch.Task(id); ti.Running != 0 || runs.Load() != tc.exp {
+			t.Errorf("%s: expected %d runs, got %d (running %d)", id, tc.exp, runs.Load(), ti.Running)
+		}
+	}
+}
+
+func TestSchedulerPause(t *testing.T) {
+	clk := NewManualClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	done := make(chan TaskInfo, 10)
+	sch := NewSchedulerWithOptions(WithClock(context.Background(), clk), &SchedulerOptions{
+		OnRun: func(ti TaskInfo) { done <- ti },
+	})
+	defer sch.StopAll()
+
+	var runs atomic.Int64
+	sch.StartWithOptions("paused", func(ctx context.Context, now time.Time) error {
+		runs.Add(1)
+		return nil
+	}, sch.Every(time.Millisecond, time.Millisecond), &TaskOptions{Paused: true})
+
+	for i := 0; i < 5; i++ {
+		clk.BlockUntil(1)
+		clk.Advance(time.Millisecond)
+	}
+	// the timer is armed again once the last activation was handled
+	clk.BlockUntil(1)
+	if n := runs.Load(); n != 0 {
+		t.Fatalf("expected 0 runs while paused, got %d", n)
+	}
+
+	sch.RunNow("paused")
+	if ti := <-done; ti.Runs != 1 {
+		t.Fatalf("expected RunNow to run a paused task, got %+v", ti)
+	}
+
+	sch.Resume("paused")
+	for i := 0; i < 5; i++ {
+		clk.BlockUntil(1)
+		clk.Advance(time.Millisecond)
+		<-done
+	}
+	if ti, _ := sch.Task("paused"); ti.Paused || ti.Runs != 6 {
+		t.Fatalf("unexpected task info after resume: %+v", ti)
+	}
+}
+
+func TestSchedulerMisfire(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "sched.json")
+	cs, _ := ParseCron("CRON_TZ=UTC @daily")
+	now := time.Date(2020, 1, 10, 12, 0, 0, 0, time.UTC)
+	midnight := now.Truncate(24 * time.Hour)
+
+	for _, tc := range []struct {
+		p     MisfirePolicy
+		opts  TaskOptions
+		every bool
+		exp   []time.Time
+	}{
+		{MisfireSkip, TaskOptions{}, false, nil},
+		{MisfireRunOnce, TaskOptions{}, false, []time.Time{midnight}},
+		{MisfireRunAll, TaskOptions{}, false, []time.Time{midnight.Add(-48 * time.Hour), midnight.Add(-24 * time.Hour), midnight}},
+		{MisfireRunAll, TaskOptions{MaxMisfires: 2}, false, []time.Time{midnight.Add(-24 * time.Hour), midnight}},
+		{MisfireRunAll, TaskOptions{Paused: true}, false, nil},
+		// interval schedules count from the last run, not from when they were started
+		{MisfireRunOnce, TaskOptions{}, true, []time.Time{midnight}},
+		{MisfireRunAll, TaskOptions{}, true, []time.Time{midnight.Add(-48 * time.Hour), midnight.Add(-24 * time.Hour), midnight}},
+	} {
+		store, err := NewFileSchedulerStore(fp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Save("daily", TaskState{LastRun: midnight.Add(-72 * time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+
+		var runs []time.Time
+		done := make(chan struct{}, 3)
+		clk := NewManualClock(now)
+		sch := NewSchedulerWithOptions(WithClock(context.Background(), clk), &SchedulerOptions{
+			Store: store,
+			OnRun: func(TaskInfo) { done <- struct{}{} },
+		})
+		var daily Schedule = cs
+		if tc.every {
+			daily = sch.Every(time.Hour, 24*time.Hour)
+		}
+		tc.opts.Misfire = tc.p
+		sch.StartWithOptions("daily", func(ctx context.Context, now time.Time) error {
+			runs = append(runs, now)
+			return nil
+		}, daily, &tc.opts)
+
+		for range tc.exp {
+			<-done
+		}
+		// the missed runs are done once the task waits for the next activation
+		clk.BlockUntil(1)
+		sch.StopAll()
+
+		if !reflect.DeepEqual(runs, tc.exp) {
+			t.Errorf("policy %d (%+v): expected %v, got %v", tc.p, tc.opts, tc.exp, runs)
+		}
+
+		if store, _ = NewFileSchedulerStore(fp); len(tc.exp) > 0 {
+			if st, _, _ := store.Load("daily"); !st.LastRun.Equal(midnight) {
+				t.Errorf("policy %d (%+v): expected the last run to be persisted, got %v", tc.p, tc.opts, st.LastRun)
+			}
+		}
 	}
 }
@@ -1,29 +1,166 @@
 package otk
 
+import (
+	"container/list"
+	"context"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// NewSem returns a semaphore with size units, a size < 1 is treated as 1.
 func NewSem(size int) *Sem {
-	if size == 0 {
+	if size < 1 {
 		size = 1
 	}
 
-	return &Sem{ch: make(chan struct{}, size)}
+	return &Sem{size: size}
 }
 
+// Sem is a weighted semaphore, waiters are served in FIFO order so a big
+// acquire can't be starved by a stream of small ones.
 type Sem struct {
-	ch chan struct{}
+	mux     sync.Mutex
+	size    int
+	cur     int
+	waiters list.List
+}
+
+type semWaiter struct {
+	n     int
+	ready chan struct{}
 }
 
 func (s *Sem) Acquire() {
-	s.ch <- struct{}{}
+	if err := s.AcquireCtx(context.Background(), 1); err != nil {
+		panic(err)
+	}
+}
+
+// AcquireCtx acquires n units, blocking until they're available or ctx is done.
+func (s *Sem) AcquireCtx(ctx context.Context, n int) error {
+	if n < 1 {
+		return xerrors.Errorf("sem: can't acquire %d", n)
+	}
+
+	s.mux.Lock()
+	if n > s.size {
+		s.mux.Unlock()
+		return xerrors.Errorf("sem: can't acquire %d, the size is %d", n, s.size)
+	}
+
+	if s.size-s.cur >= n && s.waiters.Len() == 0 {
+		s.cur += n
+		s.mux.Unlock()
+		return nil
+	}
+
+	w := semWaiter{n: n, ready: make(chan struct{})}
+	elem := s.waiters.PushBack(w)
+	s.mux.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+
+	case <-ctx.Done():
+		s.mux.Lock()
+		select {
+		case <-w.ready:
+			// acquired right after ctx was done, give it back
+			s.cur -= n
+			s.notifyLocked()
+		default:
+			isFront := s.waiters.Front() == elem
+			s.waiters.Remove(elem)
+			if isFront && s.size > s.cur {
+				s.notifyLocked()
+			}
+		}
+		s.mux.Unlock()
+		return ctx.Err()
+	}
+}
+
+// TryAcquire acquires n units without blocking, returns false if they aren't available or n < 1.
+func (s *Sem) TryAcquire(n int) bool {
+	if n < 1 {
+		return false
+	}
+
+	s.mux.Lock()
+	ok := s.size-s.cur >= n && s.waiters.Len() == 0
+	if ok {
+		s.cur += n
+	}
+	s.mux.Unlock()
+	return ok
 }
 
 func (s *Sem) Release() {
-	<-s.ch
+	s.ReleaseN(1)
+}
+
+func (s *Sem) ReleaseN(n int) {
+	if n < 1 {
+		panic("sem: released less than 1")
+	}
+
+	s.mux.Lock()
+	if s.cur -= n; s.cur < 0 {
+		s.mux.Unlock()
+		panic("sem: released more than held")
+	}
+	s.notifyLocked()
+	s.mux.Unlock()
 }
 
 func (s *Sem) Go(fn func()) {
-	s.Acquire()
+	s.GoN(1, fn)
+}
+
+// GoN acquires n units then runs fn in a goroutine, releasing them when it returns.
+func (s *Sem) GoN(n int, fn func()) {
+	if err := s.AcquireCtx(context.Background(), n); err != nil {
+		panic(err)
+	}
 	go func() {
-		defer s.Release()
+		defer s.ReleaseN(n)
 		fn()
 	}()
 }
+
+func (s *Sem) Size() int { return s.size }
+
+// Used returns the number of acquired units.
+func (s *Sem) Used() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.cur
+}
+
+// Waiters returns the number of blocked acquires.
+func (s *Sem) Waiters() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.waiters.Len()
+}
+
+func (s *Sem) notifyLocked() {
+	for {
+		next := s.waiters.Front()
+		if next == nil {
+			return
+		}
+
+		w := next.Value.(semWaiter)
+		if s.size-s.cur < w.n {
+			// keep FIFO order, don't let smaller waiters jump ahead
+			return
+		}
+
+		s.cur += w.n
+		s.waiters.Remove(next)
+		close(w.ready)
+	}
+}
@@ -0,0 +1,81 @@
+package otk
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSem(t *testing.T) {
+	s := NewSem(5)
+	if !s.TryAcquire(4) || s.TryAcquire(2) {
+		t.Fatal("unexpected TryAcquire result")
+	}
+
+	acquired := make(chan int, 2)
+	go func() {
+		s.AcquireCtx(context.Background(), 3)
+		acquired <- 3
+	}()
+	for s.Waiters() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// FIFO, the 1 unit left can't be taken while the big acquire waits
+	if s.TryAcquire(1) {
+		t.Fatal("expected TryAcquire to respect waiters")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.AcquireCtx(ctx, 1); err != context.DeadlineExceeded {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+
+	s.ReleaseN(4)
+	if n := <-acquired; n != 3 || s.Used() != 3 || s.Waiters() != 0 {
+		t.Fatalf("unexpected state: used %d, waiters %d", s.Used(), s.Waiters())
+	}
+
+	if err := s.AcquireCtx(context.Background(), 6); err == nil {
+		t.Fatal("expected acquiring more than the size to fail")
+	}
+
+	done := make(chan struct{})
+	s.GoN(2, func() { <-done })
+	if s.Used() != 5 {
+		t.Fatalf("expected 5 used, got %d", s.Used())
+	}
+	close(done)
+	s.ReleaseN(3)
+	for s.Used() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSemNegativeSize(t *testing.T) {
+	s := NewSem(-1)
+	if s.Size() != 1 {
+		t.Fatalf("expected a size of 1, got %d", s.Size())
+	}
+	s.Acquire()
+	if s.TryAcquire(1) {
+		t.Fatal("expected the sem to be full")
+	}
+	s.Release()
+
+	if s.TryAcquire(-1) || s.AcquireCtx(context.Background(), 0) == nil {
+		t.Fatal("expected acquiring less than 1 to fail")
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected releasing less than 1 to panic")
+			}
+		}()
+		s.ReleaseN(-1)
+	}()
+	if s.Used() != 0 {
+		t.Fatalf("expected nothing to be used, got %d", s.Used())
+	}
+}
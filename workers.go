@@ -3,11 +3,15 @@ package otk
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
 	"runtime"
+	"runtime/debug"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"golang.org/x/xerrors"
 )
 
 var (
@@ -15,99 +19,642 @@ var (
 	ErrPoolIsFull = errors.New("the pool is full")
 )
 
+// SubmitMode controls what Exec does when the queue is full and the pool can't grow.
+type SubmitMode uint8
+
+const (
+	// SubmitReject makes Exec return ErrPoolIsFull.
+	SubmitReject SubmitMode = iota
+	// SubmitBlock makes Exec wait for room in the queue.
+	SubmitBlock
+)
+
+// WorkersOptions configures NewWorkersWithOptions.
+type WorkersOptions struct {
+	// MinWorkers are always kept alive, defaults to 1.
+	MinWorkers int
+	// MaxWorkers is the upper bound of workers, 0 means no limit.
+	MaxWorkers int
+	// IncreaseBy is how many workers are spawned when the queue is full, defaults to 1.
+	IncreaseBy int
+	// QueueSize is how many jobs can wait for a worker, defaults to MinWorkers.
+	QueueSize int
+
+	// Lanes are separate queues ordered by priority, see ExecLane.
+	// Exec and ExecCtx use the first lane, if it's empty, there's a single unnamed lane.
+	Lanes []WorkersLane
+
+	Mode SubmitMode
+
+	// IdleTimeout is how long a worker above MinWorkers waits for a job before exiting, defaults to 5 minutes.
+	IdleTimeout time.Duration
+
+	// Logf defaults to log.Printf.
+	Logf func(format string, args ...any)
+
+	// OnPanic is called with the recovered panic of a job, defaults to logging it with its stack.
+	OnPanic func(err *PanicError)
+
+	// OnJobStart is called before a job runs with how long it waited in the queue.
+	OnJobStart func(waited time.Duration)
+	// OnJobDone is called after a job returns with how long it took, err is a *PanicError if it panicked.
+	OnJobDone func(took time.Duration, err error)
+}
+
+// WorkersLane is a queue with its own priority and size.
+// Every dequeue prefers a lane based on the weights using a weighted round robin,
+// and falls back to the others in priority order if it's empty, so lower lanes still make progress.
+type WorkersLane struct {
+	Name string
+	// Weight defaults to 1.
+	Weight int
+	// QueueSize defaults to WorkersOptions.QueueSize.
+	QueueSize int
+}
+
+// PanicError is a panic recovered from a job.
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string { return fmt.Sprintf("workers: job panicked: %v", e.Value) }
+
+// WorkersStats is returned by Workers.Stats.
+type WorkersStats struct {
+	Workers int
+	Queued  int
+	Running int
+
+	// LanesQueued is the number of queued jobs per lane.
+	LanesQueued map[string]int
+
+	Completed int64
+	Panicked  int64
+	Rejected  int64
+}
+
+// NewWorkers is a shortcut for NewWorkersWithOptions with initial min workers and queue size,
+// the pool grows by increaseBy without a limit, or never if it's 0.
 func NewWorkers(ctx context.Context, initial, increaseBy int) *Workers {
+	opts := &WorkersOptions{
+		MinWorkers: initial,
+		IncreaseBy: increaseBy,
+		QueueSize:  initial,
+	}
+	if increaseBy < 1 {
+		opts.MaxWorkers = initial
+	}
+	return NewWorkersWithOptions(ctx, opts)
+}
+
+func NewWorkersWithOptions(ctx context.Context, opts *WorkersOptions) *Workers {
+	var o WorkersOptions
+	if opts != nil {
+		o = *opts
+	}
+
+	if o.MinWorkers < 1 {
+		o.MinWorkers = 1
+	}
+
+	if o.MaxWorkers > 0 && o.MaxWorkers < o.MinWorkers {
+		o.MaxWorkers = o.MinWorkers
+	}
+
+	if o.IncreaseBy < 1 {
+		o.IncreaseBy = 1
+	}
+
+	if o.QueueSize < 1 {
+		o.QueueSize = o.MinWorkers
+	}
+
+	if o.IdleTimeout < 1 {
+		o.IdleTimeout = 5 * time.Minute
+	}
+
+	if o.Logf == nil {
+		o.Logf = log.Printf
+	}
+
+	if o.OnPanic == nil {
+		logf := o.Logf
+		o.OnPanic = func(err *PanicError) { logf("%v\n%s", err, err.Stack) }
+	}
+
+	if len(o.Lanes) == 0 {
+		o.Lanes = []WorkersLane{{}}
+	}
+
 	ctx, cfn := context.WithCancel(ctx)
 	w := &Workers{
-		ch:  make(chan func(ctx context.Context), initial),
-		ctx: ctx,
-		cfn: cfn,
-		inc: increaseBy,
+		opts:    o,
+		lanes:   make([]workerLane, len(o.Lanes)),
+		closing: make(chan struct{}),
+		ctx:     ctx,
+		cfn:     cfn,
+		clk:     ClockFromContext(ctx),
+		keys:    map[string]*keyedEntry{},
+	}
+
+	var size int
+	for i, l := range o.Lanes {
+		if l.Weight < 1 {
+			l.Weight = 1
+		}
+		if l.QueueSize < 1 {
+			l.QueueSize = o.QueueSize
+		}
+		w.lanes[i] = workerLane{name: l.Name, weight: l.Weight, ch: make(chan workerJob, l.QueueSize)}
+		size += l.QueueSize
 	}
-	go w.init(initial)
+	// every queued job has a token, so workers only have to wait on one channel
+	w.ready = make(chan struct{}, size)
+
+	w.total = int64(o.MinWorkers)
+	w.spawn(o.MinWorkers)
 	return w
 }
 
 type Workers struct {
-	mux   sync.Mutex
-	ch    chan func(ctx context.Context)
-	ctx   context.Context
-	cfn   context.CancelFunc
-	inc   int
-	total int64
+	opts WorkersOptions
+
+	mux      sync.RWMutex
+	lanes    []workerLane
+	ready    chan struct{}
+	closing  chan struct{}
+	stopOnce sync.Once
+	ctx      context.Context
+	cfn      context.CancelFunc
+	clk      Clock
+	wg       sync.WaitGroup
+	total    int64
+
+	queued   atomic.Int64
+	running  atomic.Int64
+	done     atomic.Int64
+	panicked atomic.Int64
+	rejected atomic.Int64
+
+	keysMux     sync.Mutex
+	keys        map[string]*keyedEntry
+	keyedQueued atomic.Int64
+
+	rl atomic.Pointer[RateLimiter]
+}
+
+func (w *Workers) Exec(fn func(context.Context)) error {
+	return w.ExecCtx(context.Background(), fn)
 }
 
-func (w *Workers) Exec(fn func(context.Context)) (_ error) {
-	if err := w.ctx.Err(); err != nil {
+// ExecCtx queues fn on the first lane, growing the pool if the queue is full,
+// in SubmitBlock mode it waits for room in the queue until ctx is done.
+func (w *Workers) ExecCtx(ctx context.Context, fn func(context.Context)) error {
+	return w.exec(ctx, &w.lanes[0], workerJob{fn: fn})
+}
+
+// ExecLane is like ExecCtx but queues fn on the named lane.
+func (w *Workers) ExecLane(ctx context.Context, lane string, fn func(context.Context)) error {
+	for i := range w.lanes {
+		if l := &w.lanes[i]; l.name == lane {
+			return w.exec(ctx, l, workerJob{fn: fn})
+		}
+	}
+	return xerrors.Errorf("workers: unknown lane %q", lane)
+}
+
+// ExecKeyed is like ExecCtx, but jobs with the same key never run at the same time and run in the order they were queued.
+// Only the first job of a busy key takes a queue slot, the others run one after another on the same worker once it's done,
+// up to the first lane's QueueSize of them per key, after that Mode applies like it does for a full queue.
+func (w *Workers) ExecKeyed(ctx context.Context, key string, fn func(context.Context)) error {
+	for {
+		w.keysMux.Lock()
+		e := w.keys[key]
+		if e == nil {
+			e = &keyedEntry{ready: make(chan struct{})}
+			w.keys[key] = e
+			w.keysMux.Unlock()
+
+			err := w.exec(ctx, &w.lanes[0], workerJob{fn: fn, key: key, keyed: true})
+
+			w.keysMux.Lock()
+			if err != nil {
+				delete(w.keys, key)
+			}
+			close(e.ready)
+			w.keysMux.Unlock()
+			return err
+		}
+
+		wait := e.ready
+		select {
+		case <-e.ready:
+			if w.isClosing() || w.ctx.Err() != nil {
+				w.keysMux.Unlock()
+				return ErrClosedPool
+			}
+
+			if len(e.pending) < cap(w.lanes[0].ch) {
+				e.pending = append(e.pending, workerJob{fn: fn, queued: w.clk.Now(), key: key, keyed: true})
+				w.keyedQueued.Add(1)
+				w.keysMux.Unlock()
+				w.queued.Add(1)
+				return nil
+			}
+
+			if w.opts.Mode != SubmitBlock {
+				w.keysMux.Unlock()
+				w.rejected.Add(1)
+				w.opts.Logf("workers: we are being overrun :(, key %q: %v", key, len(e.pending))
+				return ErrPoolIsFull
+			}
+
+			if e.room == nil {
+				e.room = make(chan struct{})
+			}
+			wait = e.room
+		default:
+			// the key's first job is still being queued, if that fails we take its place
+		}
+		w.keysMux.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-w.closing:
+			return ErrClosedPool
+		}
+	}
+}
+
+func (w *Workers) exec(ctx context.Context, l *workerLane, j workerJob) error {
+	// the read lock guards against Close/Shutdown closing the channel while we're sending
+	w.mux.RLock()
+	defer w.mux.RUnlock()
+	if w.isClosing() || w.ctx.Err() != nil {
 		return ErrClosedPool
 	}
 
+	j.queued = w.clk.Now()
 	for i := 0; i < 3; i++ {
 		select {
-		case w.ch <- fn:
-			return
-		case <-w.ctx.Done():
-			return ErrClosedPool
+		case l.ch <- j:
+			w.enqueued()
+			return nil
 		default:
-			w.spawn(w.inc)
-			runtime.Gosched()
 		}
+
+		if !w.grow() {
+			break
+		}
+		runtime.Gosched()
+	}
+
+	if w.opts.Mode != SubmitBlock {
+		w.rejected.Add(1)
+		w.opts.Logf("workers: we are being overrun :(, count: %v, lane %q: %v", atomic.LoadInt64(&w.total), l.name, len(l.ch))
+		return ErrPoolIsFull
+	}
+
+	select {
+	case l.ch <- j:
+		w.enqueued()
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-w.closing:
+		return ErrClosedPool
+	case <-w.ctx.Done():
+		return ErrClosedPool
 	}
+}
+
+func (w *Workers) enqueued() {
+	w.queued.Add(1)
+	// can't block, there's never more tokens than queued jobs
+	w.ready <- struct{}{}
+}
 
-	log.Printf("workers: we are being overrun :(, count: %v, chan: %v", atomic.LoadInt64(&w.total), len(w.ch))
-	return ErrPoolIsFull
+// Workers returns the number of running workers.
+func (w *Workers) Workers() int {
+	return int(atomic.LoadInt64(&w.total))
 }
 
+// Stats returns a snapshot of the pool's counters, Completed includes Panicked jobs.
+func (w *Workers) Stats() WorkersStats {
+	st := WorkersStats{
+		Workers: w.Workers(),
+		Running: int(w.running.Load()),
+
+		LanesQueued: make(map[string]int, len(w.lanes)),
+
+		Completed: w.done.Load(),
+		Panicked:  w.panicked.Load(),
+		Rejected:  w.rejected.Load(),
+	}
+
+	for i := range w.lanes {
+		l := &w.lanes[i]
+		st.Queued += len(l.ch)
+		st.LanesQueued[l.name] = len(l.ch)
+	}
+
+	// jobs waiting behind a busy key belong to the first lane
+	keyed := int(w.keyedQueued.Load())
+	st.Queued += keyed
+	st.LanesQueued[w.lanes[0].name] += keyed
+	return st
+}
+
+// SetRateLimiter limits how many jobs start per second across all the workers, nil removes the limit.
+func (w *Workers) SetRateLimiter(rl *RateLimiter) {
+	w.rl.Store(rl)
+}
+
+// Close stops the pool right away, queued jobs are dropped and running ones see their context canceled,
+// it also cancels a pending Shutdown. Returns ErrClosedPool if the pool was already closed and canceled.
 func (w *Workers) Close() error {
-	if w.ctx.Err() != nil {
+	canceled := w.ctx.Err() != nil
+	stopped := w.stop()
+	w.cfn()
+	if !stopped && canceled {
 		return ErrClosedPool
 	}
-	w.cfn()
-	close(w.ch)
 	return nil
 }
 
-func (w *Workers) init(n int) {
-	w.spawn(n)
-	tk := time.NewTicker(time.Minute * 5)
-	defer tk.Stop()
+// Shutdown stops accepting new jobs, then waits for the queued and running ones to finish or ctx to be done.
+// If ctx is done first, the pool's context is canceled and the number of jobs that didn't finish is returned with ctx's error.
+func (w *Workers) Shutdown(ctx context.Context) (abandoned int, err error) {
+	if !w.stop() {
+		return 0, ErrClosedPool
+	}
+	defer w.cfn()
+
+	drained := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return 0, nil
+	case <-ctx.Done():
+		w.cfn()
+		return int(w.queued.Load() - w.done.Load()), ctx.Err()
+	}
+}
+
+func (w *Workers) stop() (ok bool) {
+	w.stopOnce.Do(func() {
+		// wakes up blocked ExecCtx calls so we can take the lock
+		close(w.closing)
+
+		w.mux.Lock()
+		close(w.ready)
+		w.mux.Unlock()
+		ok = true
+	})
+	return
+}
+
+func (w *Workers) isClosing() bool {
+	select {
+	case <-w.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// grow spawns up to IncreaseBy workers without going over MaxWorkers, returns false if it can't.
+func (w *Workers) grow() bool {
 	for {
-		select {
-		case <-tk.C:
-			// skip if the channel isn't empty or the number of workers is less than the initial
-			if len(w.ch) > 0 || atomic.LoadInt64(&w.total) <= int64(cap(w.ch)) {
-				continue
+		total := atomic.LoadInt64(&w.total)
+		n := int64(w.opts.IncreaseBy)
+		if limit := int64(w.opts.MaxWorkers); limit > 0 && total+n > limit {
+			if n = limit - total; n < 1 {
+				return false
 			}
-			for i := 0; i < w.inc; i++ {
-				select {
-				case <-w.ctx.Done():
-					return
-				case w.ch <- nil:
-				}
-			}
-			atomic.AddInt64(&w.total, -int64(w.inc))
-		case <-w.ctx.Done():
-			return
+		}
+
+		if atomic.CompareAndSwapInt64(&w.total, total, total+n) {
+			w.spawn(int(n))
+			return true
+		}
+	}
+}
+
+// release accounts for an idle worker exiting, returns false if it would go under MinWorkers.
+func (w *Workers) release() bool {
+	for {
+		total := atomic.LoadInt64(&w.total)
+		if total <= int64(w.opts.MinWorkers) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&w.total, total, total-1) {
+			return true
 		}
 	}
 }
 
+// spawn starts n workers, the caller is responsible for adding them to total.
 func (w *Workers) spawn(n int) {
+	w.wg.Add(n)
 	for i := 0; i < n; i++ {
 		go w.worker()
 	}
-	atomic.AddInt64(&w.total, int64(n))
 }
 
 func (w *Workers) worker() {
+	var released bool
+	defer func() {
+		if !released {
+			atomic.AddInt64(&w.total, -1)
+		}
+		w.wg.Done()
+	}()
+
+	idle := w.clk.NewTimer(w.opts.IdleTimeout)
+	defer idle.Stop()
+
+	cur := make([]int, len(w.lanes))
 	for {
 		select {
-		case fn := <-w.ch:
-			if fn == nil {
+		case _, ok := <-w.ready:
+			if !ok || w.ctx.Err() != nil {
+				return
+			}
+			j := w.dequeue(cur)
+			if !w.limit() {
+				if j.keyed {
+					w.runKeyed(j.key)
+				}
+				return
+			}
+			w.run(j)
+			if j.keyed {
+				w.runKeyed(j.key)
+			}
+
+			if !idle.Stop() {
+				select {
+				case <-idle.C():
+				default:
+				}
+			}
+			idle.Reset(w.opts.IdleTimeout)
+
+		case <-idle.C():
+			if released = w.release(); released {
 				return
 			}
-			fn(w.ctx)
+			idle.Reset(w.opts.IdleTimeout)
+
 		case <-w.ctx.Done():
 			return
 		}
 	}
 }
+
+type workerLane struct {
+	name   string
+	weight int
+	ch     chan workerJob
+}
+
+// dequeue takes a job after a ready token was received, cur holds the worker's round robin state.
+func (w *Workers) dequeue(cur []int) workerJob {
+	if len(w.lanes) == 1 {
+		return <-w.lanes[0].ch
+	}
+
+	best, total := 0, 0
+	for i := range w.lanes {
+		cur[i] += w.lanes[i].weight
+		total += w.lanes[i].weight
+		if cur[i] > cur[best] {
+			best = i
+		}
+	}
+	cur[best] -= total
+
+	select {
+	case j := <-w.lanes[best].ch:
+		return j
+	default:
+	}
+
+	// the token guarantees there's a job for us, but another worker might take the one we saw first
+	for {
+		for i := range w.lanes {
+			select {
+			case j := <-w.lanes[i].ch:
+				return j
+			default:
+			}
+		}
+		runtime.Gosched()
+	}
+}
+
+type workerJob struct {
+	fn     func(ctx context.Context)
+	queued time.Time
+	key    string
+	keyed  bool
+}
+
+type keyedEntry struct {
+	pending []workerJob
+	// closed once the key's first job is queued
+	ready chan struct{}
+	// closed when a pending job is taken, if anyone is waiting for room
+	room chan struct{}
+}
+
+// limit waits on the rate limiter, returns false only if the pool's context is done first.
+func (w *Workers) limit() bool {
+	rl := w.rl.Load()
+	if rl == nil || rl.Wait(w.ctx) == nil {
+		return true
+	}
+	if w.ctx.Err() != nil {
+		return false
+	}
+	// Wait gives up early if the context's deadline would pass first, but we already took the job, so sleep until it's due
+	return sleepCtx(w.ctx, rl.clk, rl.Reserve().Delay()) == nil
+}
+
+// runKeyed runs the jobs that were queued behind key's first one, then releases the key.
+// It's called on every worker exit path once the first job was taken, so the key is never left behind.
+func (w *Workers) runKeyed(key string) {
+	for {
+		w.keysMux.Lock()
+		e := w.keys[key]
+		if len(e.pending) == 0 || w.ctx.Err() != nil {
+			// the pool is done, the pending jobs are dropped like the rest of the queue
+			delete(w.keys, key)
+			w.keyedQueued.Add(-int64(len(e.pending)))
+			e.wakeLocked()
+			w.keysMux.Unlock()
+			return
+		}
+		w.keysMux.Unlock()
+
+		// only take the job once it's allowed to run, this is the only place that takes them so it's still there
+		if !w.limit() {
+			continue
+		}
+
+		w.keysMux.Lock()
+		j := e.pending[0]
+		e.pending[0] = workerJob{}
+		e.pending = e.pending[1:]
+		w.keyedQueued.Add(-1)
+		e.wakeLocked()
+		w.keysMux.Unlock()
+
+		w.run(j)
+	}
+}
+
+// wakeLocked wakes up the ExecKeyed calls waiting for room.
+func (e *keyedEntry) wakeLocked() {
+	if e.room != nil {
+		close(e.room)
+		e.room = nil
+	}
+}
+
+func (w *Workers) run(j workerJob) {
+	start := w.clk.Now()
+	w.running.Add(1)
+	if w.opts.OnJobStart != nil {
+		w.opts.OnJobStart(start.Sub(j.queued))
+	}
+
+	var err error
+	defer func() {
+		if p := recover(); p != nil {
+			pe, ok := p.(*PanicError)
+			if !ok {
+				pe = &PanicError{Value: p, Stack: debug.Stack()}
+			}
+			err = pe
+			w.panicked.Add(1)
+			w.opts.OnPanic(pe)
+		}
+
+		w.running.Add(-1)
+		w.done.Add(1)
+		if w.opts.OnJobDone != nil {
+			w.opts.OnJobDone(w.clk.Now().Sub(start), err)
+		}
+	}()
+
+	j.fn(w.ctx)
+}
@@ -0,0 +1,359 @@
+package otk
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkersShutdown(t *testing.T) {
+	w := NewWorkers(context.Background(), 2, 1)
+	var n atomic.Int64
+	for i := 0; i < 10; i++ {
+		w.Exec(func(context.Context) {
+			time.Sleep(time.Millisecond)
+			n.Add(1)
+		})
+	}
+
+	if abandoned, err := w.Shutdown(context.Background()); abandoned != 0 || err != nil {
+		t.Fatalf("unexpected shutdown result: %v %v", abandoned, err)
+	}
+	if n.Load() != 10 {
+		t.Fatalf("expected all the queued jobs to run, got %d", n.Load())
+	}
+	if err := w.Exec(func(context.Context) {}); err != ErrClosedPool {
+		t.Fatalf("expected ErrClosedPool, got %v", err)
+	}
+
+	w = NewWorkers(context.Background(), 1, 0)
+	block := make(chan struct{})
+	defer close(block)
+	started := make(chan struct{})
+	w.Exec(func(context.Context) { close(started); <-block })
+	<-started
+	w.Exec(func(context.Context) {})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if abandoned, err := w.Shutdown(ctx); abandoned != 2 || err != context.DeadlineExceeded {
+		t.Fatalf("unexpected shutdown result: %v %v", abandoned, err)
+	}
+
+	// Close cancels the running jobs of a pending Shutdown
+	w = NewWorkers(context.Background(), 1, 0)
+	started = make(chan struct{})
+	w.Exec(func(ctx context.Context) { close(started); <-ctx.Done() })
+	<-started
+	shutdown := make(chan error)
+	go func() {
+		_, err := w.Shutdown(context.Background())
+		shutdown <- err
+	}()
+	for w.Exec(func(context.Context) {}) != ErrClosedPool {
+		time.Sleep(time.Millisecond)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("expected Close to cancel the pool, got %v", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatalf("unexpected shutdown result: %v", err)
+	}
+	if err := w.Close(); err != ErrClosedPool {
+		t.Fatalf("expected ErrClosedPool, got %v", err)
+	}
+}
+
+func TestWorkersCloseRace(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		w := NewWorkers(context.Background(), 1, 1)
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for k := 0; k < 50; k++ {
+					w.Exec(func(context.Context) {})
+				}
+			}()
+		}
+		w.Close()
+		wg.Wait()
+	}
+}
+
+func TestWorkersOptions(t *testing.T) {
+	clk := NewManualClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	w := NewWorkersWithOptions(WithClock(context.Background(), clk), &WorkersOptions{
+		MinWorkers:  1,
+		MaxWorkers:  3,
+		IncreaseBy:  2,
+		QueueSize:   1,
+		IdleTimeout: time.Minute,
+		Mode:        SubmitBlock,
+	})
+	defer w.Close()
+
+	var started atomic.Int64
+	block := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		if err := w.Exec(func(context.Context) { started.Add(1); <-block }); err != nil {
+			t.Fatalf("unexpected error at %d: %v", i, err)
+		}
+	}
+
+	// 3 running, 1 queued
+	for started.Load() != 3 || w.Stats().Queued != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if n := w.Workers(); n != 3 {
+		t.Fatalf("expected 3 workers, got %d", n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := w.ExecCtx(ctx, func(context.Context) {}); err != context.Canceled {
+		t.Fatalf("expected the pool to be full, got %v", err)
+	}
+
+	close(block)
+	for w.done.Load() != 4 {
+		time.Sleep(time.Millisecond)
+	}
+	clk.BlockUntil(3)
+	clk.Advance(time.Minute)
+	for w.Workers() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWorkersBlock(t *testing.T) {
+	w := NewWorkersWithOptions(context.Background(), &WorkersOptions{MaxWorkers: 1, Mode: SubmitBlock})
+
+	block, started := make(chan struct{}), make(chan struct{})
+	w.Exec(func(context.Context) { close(started); <-block })
+	<-started
+	w.Exec(func(context.Context) {})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := w.ExecCtx(ctx, func(context.Context) {}); err != context.DeadlineExceeded {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+
+	done := make(chan error)
+	go func() { done <- w.Exec(func(context.Context) {}) }()
+	close(block)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	go func() { done <- w.Exec(func(context.Context) { <-block }) }()
+	w.Close()
+	if err := <-done; err != nil && err != ErrClosedPool {
+		t.Fatal(err)
+	}
+}
+
+func TestWorkersPanic(t *testing.T) {
+	var (
+		mux    sync.Mutex
+		panics []*PanicError
+		errs   []error
+	)
+	w := NewWorkersWithOptions(context.Background(), &WorkersOptions{
+		MaxWorkers: 1,
+		Mode:       SubmitBlock,
+		OnPanic: func(err *PanicError) {
+			mux.Lock()
+			panics = append(panics, err)
+			mux.Unlock()
+		},
+		OnJobDone: func(took time.Duration, err error) {
+			mux.Lock()
+			errs = append(errs, err)
+			mux.Unlock()
+		},
+	})
+
+	w.Exec(func(context.Context) { panic("boom") })
+	f, _ := Submit(context.Background(), w, func(context.Context) (int, error) { panic("bang") })
+	w.Exec(func(context.Context) {})
+
+	var pe *PanicError
+	if _, err := f.Wait(context.Background()); !errors.As(err, &pe) || pe.Value != "bang" {
+		t.Fatalf("expected a PanicError, got %v", err)
+	}
+
+	w.Shutdown(context.Background())
+
+	st := w.Stats()
+	if st.Completed != 3 || st.Panicked != 2 || st.Running != 0 || st.Queued != 0 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+
+	if len(panics) != 2 || panics[0].Value != "boom" || !bytes.Contains(panics[0].Stack, []byte("TestWorkersPanic")) {
+		t.Fatalf("unexpected panics: %v", panics)
+	}
+	if len(errs) != 3 || errs[0] != panics[0] || errs[2] != nil {
+		t.Fatalf("unexpected job errors: %v", errs)
+	}
+}
+
+func TestWorkersLanes(t *testing.T) {
+	w := NewWorkersWithOptions(context.Background(), &WorkersOptions{
+		MaxWorkers: 1,
+		Lanes:      []WorkersLane{{Name: "high", Weight: 3}, {Name: "low", QueueSize: 4}},
+		QueueSize:  6,
+	})
+
+	block, started := make(chan struct{}), make(chan struct{})
+	w.Exec(func(context.Context) { close(started); <-block })
+	<-started
+
+	var order []byte
+	for i := 0; i < 4; i++ {
+		if err := w.ExecLane(context.Background(), "low", func(context.Context) { order = append(order, 'L') }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 6; i++ {
+		if err := w.ExecLane(context.Background(), "high", func(context.Context) { order = append(order, 'H') }); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if st := w.Stats(); st.LanesQueued["high"] != 6 || st.LanesQueued["low"] != 4 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+	if err := w.ExecLane(context.Background(), "nope", func(context.Context) {}); err == nil {
+		t.Fatal("expected an unknown lane error")
+	}
+
+	close(block)
+	w.Shutdown(context.Background())
+	// the blocking job took the first high turn, then it's 3 high for every low until high is empty
+	if string(order) != "HLHHHLHHLL" {
+		t.Fatalf("unexpected order: %s", order)
+	}
+}
+
+func TestWorkersKeyed(t *testing.T) {
+	w := NewWorkersWithOptions(context.Background(), &WorkersOptions{MinWorkers: 4, QueueSize: 16, Mode: SubmitBlock})
+
+	var (
+		mux    sync.Mutex
+		seen   = map[string][]int{}
+		active = map[string]int{}
+	)
+	for i := 0; i < 100; i++ {
+		i, key := i, strconv.Itoa(i%3)
+		err := w.ExecKeyed(context.Background(), key, func(context.Context) {
+			mux.Lock()
+			if active[key]++; active[key] > 1 {
+				t.Errorf("key %s is running concurrently", key)
+			}
+			seen[key] = append(seen[key], i)
+			mux.Unlock()
+
+			time.Sleep(time.Microsecond)
+
+			mux.Lock()
+			active[key]--
+			mux.Unlock()
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := w.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, ids := range seen {
+		if !sort.IntsAreSorted(ids) {
+			t.Fatalf("key %s ran out of order: %v", key, ids)
+		}
+	}
+	if len(seen["0"])+len(seen["1"])+len(seen["2"]) != 100 {
+		t.Fatalf("expected 100 jobs, got %v", seen)
+	}
+	if len(w.keys) != 0 {
+		t.Fatalf("expected the keys to be released, got %d", len(w.keys))
+	}
+}
+
+func TestWorkersKeyedLimits(t *testing.T) {
+	w := NewWorkersWithOptions(context.Background(), &WorkersOptions{MinWorkers: 1, MaxWorkers: 1, QueueSize: 2})
+	defer w.Close()
+
+	clk := NewManualClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	w.SetRateLimiter(NewRateLimiter(WithClock(context.Background(), clk), 1, 1))
+
+	var n atomic.Int64
+	block, started := make(chan struct{}), make(chan struct{})
+	if err := w.ExecKeyed(context.Background(), "k", func(context.Context) { close(started); <-block }); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	// the jobs behind a busy key are bound by the queue size and count as queued
+	for i := 0; i < 2; i++ {
+		if err := w.ExecKeyed(context.Background(), "k", func(context.Context) { n.Add(1) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.ExecKeyed(context.Background(), "k", func(context.Context) {}); err != ErrPoolIsFull {
+		t.Fatalf("expected ErrPoolIsFull, got %v", err)
+	}
+	if st := w.Stats(); st.Queued != 2 || st.Rejected != 1 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+
+	// and wait on the rate limiter like any other job
+	close(block)
+	clk.BlockUntil(1)
+	if n.Load() != 0 {
+		t.Fatal("expected the keyed job to wait on the rate limiter")
+	}
+	clk.Advance(time.Second)
+	clk.BlockUntil(1)
+	clk.Advance(time.Second)
+	for n.Load() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWorkersKeyedRelease(t *testing.T) {
+	w := NewWorkersWithOptions(context.Background(), &WorkersOptions{MinWorkers: 1, MaxWorkers: 1, QueueSize: 2})
+	clk := NewManualClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	w.SetRateLimiter(NewRateLimiter(WithClock(context.Background(), clk), 1, 1))
+
+	block, started := make(chan struct{}), make(chan struct{})
+	w.ExecKeyed(context.Background(), "k", func(context.Context) { close(started); <-block })
+	<-started
+	w.ExecKeyed(context.Background(), "k", func(context.Context) { t.Error("the pending job shouldn't run after Close") })
+	close(block)
+
+	// the pending job is waiting on the limiter when the pool is closed, the key must still be released
+	clk.BlockUntil(1)
+	w.Close()
+	w.wg.Wait()
+
+	w.keysMux.Lock()
+	n := len(w.keys)
+	w.keysMux.Unlock()
+	if st := w.Stats(); n != 0 || st.Queued != 0 {
+		t.Fatalf("expected the key to be released, got %d keys and %d queued", n, st.Queued)
+	}
+	if err := w.ExecKeyed(context.Background(), "k", func(context.Context) {}); err != ErrClosedPool {
+		t.Fatalf("expected ErrClosedPool, got %v", err)
+	}
+}